@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"teleporter/agent"
+	"teleporter/logger"
+)
+
+// nodeCertPaths returns the node's certificate & key paths, relative paths are taken from the config file's directory
+func nodeCertPaths(confFile string, conf *agent.AgentConfig) (string, string) {
+	certFile, keyFile := conf.CertFile, conf.KeyFile
+	if certFile == "" {
+		certFile = "server.crt"
+	}
+	if keyFile == "" {
+		keyFile = "server.key"
+	}
+
+	confDir := filepath.Dir(confFile)
+	if !filepath.IsAbs(certFile) {
+		certFile = filepath.Join(confDir, certFile)
+	}
+	if !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(confDir, keyFile)
+	}
+	return certFile, keyFile
+}
+
+// fingerprintFile is where the certificate's fingerprint is kept for the user to hand out, next to the certificate
+func fingerprintFile(certFile string) string {
+	return strings.TrimSuffix(certFile, filepath.Ext(certFile)) + ".fingerprint"
+}
+
+func publishFingerprint(certFile, fingerprint string) {
+	err := ioutil.WriteFile(fingerprintFile(certFile), []byte(fingerprint+"\n"), 0644)
+	if err != nil {
+		logger.Error("failed writing certificate fingerprint: ", err)
+	}
+	fmt.Println("Node certificate fingerprint (pin it as \"fingerprint\" in the tethers of peers):", fingerprint)
+}
+
+// ensureNodeIdentity generates the node's certificate on first run, and prints the fingerprint peers should pin
+func ensureNodeIdentity(confFile string, conf *agent.AgentConfig) (string, string, error) {
+	certFile, keyFile := nodeCertPaths(confFile, conf)
+	fingerprint, err := agent.EnsureNodeCert(certFile, keyFile, conf.NetworkConfiguration.ClientId)
+	if err != nil {
+		return "", "", err
+	}
+	publishFingerprint(certFile, fingerprint)
+	return certFile, keyFile, nil
+}
+
+// runCertCommand handles: cli cert <rotate|show> [config.json]
+func runCertCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: cli cert <rotate|show> [config.json]")
+	}
+	confFile := "./config.json"
+	if len(args) > 1 {
+		confFile = args[1]
+	}
+	conf, err := readConfig(confFile)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "show":
+		_, _, err = ensureNodeIdentity(confFile, conf)
+		return err
+	case "rotate":
+		certFile, keyFile := nodeCertPaths(confFile, conf)
+		fingerprint, err := agent.GenerateNodeCert(certFile, keyFile, conf.NetworkConfiguration.ClientId)
+		if err != nil {
+			return err
+		}
+		publishFingerprint(certFile, fingerprint)
+		fmt.Println("The certificate was rotated, restart the node and update the fingerprint pinned by its peers")
+		return nil
+	default:
+		return errors.New("unknown cert command: " + args[0] + ", use rotate or show")
+	}
+}
@@ -8,8 +8,8 @@ import (
 	"os/signal"
 	"strconv"
 
-	"github.com/amitbet/teleporter/agent"
-	"github.com/amitbet/teleporter/logger"
+	"teleporter/agent"
+	"teleporter/logger"
 )
 
 func readConfig(file string) (*agent.AgentConfig, error) {
@@ -56,6 +56,15 @@ func main() {
 	confFile := "./config.json"
 	argsWithoutProg := os.Args[1:]
 
+	if len(argsWithoutProg) > 0 && argsWithoutProg[0] == "cert" {
+		err := runCertCommand(argsWithoutProg[1:])
+		if err != nil {
+			logger.Error("cert: ", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(argsWithoutProg) > 0 {
 		confFile = argsWithoutProg[0]
 	}
@@ -65,17 +74,22 @@ func main() {
 		//os.Create(confFile)
 		conf := agent.AgentConfig{
 			NumConnsPerTether: 10,
+			CertFile:          "server.crt",
+			KeyFile:           "server.key",
 			NetworkConfiguration: agent.ClientConfig{
 				ClientId: host,
 				Mapping:  make(map[string]string),
 			},
 			Connections: []agent.TetherConfig{
 				agent.TetherConfig{
-					TargetPort:     10201,
-					TargetHost:     "[RemoteHost Address Or IP]",
-					ConnectionType: "tls",
-					ConnectionName: "[Some name or description like: network Node #2, should have Id = HomeComputer]",
-					ClientPassword: "[Secret string for the client]",
+					TargetPort:            10201,
+					TargetHost:            "[RemoteHost Address Or IP]",
+					ConnectionType:        "tls",
+					Fingerprint:           "[Fingerprint of the remote node's certificate, printed on it by: cli cert show]",
+					ConnectionName:        "[Some name or description like: network Node #2, should have Id = HomeComputer]",
+					ClientPassword:        "[Secret string for the client]",
+					HeartbeatIntervalSecs: 20,
+					HeartbeatTimeoutSecs:  10,
 				},
 			},
 			Servers: []agent.ListenerConfig{
@@ -94,8 +108,10 @@ func main() {
 					LocalOnly:         false,
 					UseAuthentication: true,
 					AuthorizedClients: map[string]string{
-						"firstClient":   agent.GenerateRandomString(32),
+						"firstClient": agent.GenerateRandomString(32),
 					},
+					HeartbeatIntervalSecs: 20,
+					HeartbeatTimeoutSecs:  10,
 				},
 			},
 		}
@@ -106,7 +122,11 @@ func main() {
 		if err != nil {
 			logger.Error("error in writing config: ", err)
 		}
-		fmt.Println("A Configuration file 'config.json' was written, please edit it and relaunch!")
+		_, _, err = ensureNodeIdentity(confFile, &conf)
+		if err != nil {
+			logger.Error("error in generating the node certificate: ", err)
+		}
+		fmt.Println("A Configuration file '" + confFile + "' was written, please edit it and relaunch!")
 		return
 	}
 
@@ -116,8 +136,15 @@ func main() {
 		return
 	}
 
+	certFile, keyFile, err := ensureNodeIdentity(confFile, cconf)
+	if err != nil {
+		logger.Error("Problem with the node certificate: ", err)
+		return
+	}
+
 	rtr := agent.NewRouter()
 	rtr.NetworkConfig = &cconf.NetworkConfiguration
+	rtr.Proxy = cconf.Proxy
 
 	//facilitate all connections
 	for _, connConf := range cconf.Connections {
@@ -130,13 +157,17 @@ func main() {
 
 		targetURI := connConf.TargetHost + ":" + strconv.Itoa(connConf.TargetPort)
 		if err != nil {
-			logger.Error("Agent: failed to connect to "+targetURI+": ", err)
+			logger.Error("Agent: failed to connect to "+targetURI+", will keep retrying in the background: ", err)
+			continue
 		}
 		logger.Info("Agent connected with: "+connConf.ConnectionType+" to ", targetURI)
 	}
 
 	//run all server listerners:
 	for _, listenConf := range cconf.Servers {
+		if listenConf.CertFile == "" && listenConf.KeyFile == "" {
+			listenConf.CertFile, listenConf.KeyFile = certFile, keyFile
+		}
 		err := rtr.Serve(listenConf)
 		if err != nil {
 			logger.Error("Agent: failed to run listener: ", err)
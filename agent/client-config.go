@@ -6,6 +6,38 @@ type ListenerConfig struct {
 	LocalOnly         bool              `json:"acceptLocalOnly"`
 	UseAuthentication bool              `json:"useAuthentication"`
 	AuthorizedClients map[string]string `json:"authClients"`
+
+	// relayWebSockets only: the http path accepting websocket upgrades (default "/"),
+	// and whether to serve plain ws, for listeners behind a tls terminating reverse proxy
+	Path  string `json:"path,omitempty"`
+	NoTls bool   `json:"noTls,omitempty"`
+
+	// keepalive pings sent on every accepted physical connection, zero interval disables them
+	HeartbeatIntervalSecs int `json:"heartbeatIntervalSecs,omitempty"`
+	HeartbeatTimeoutSecs  int `json:"heartbeatTimeoutSecs,omitempty"`
+
+	// how streams are spread over the physical connections of accepted tethers:
+	// round-robin, least-streams (default), lowest-rtt or least-bytes
+	Scheduling string `json:"scheduling,omitempty"`
+
+	// relay listeners only: the served certificate (default server.crt/server.key in the working directory),
+	// and a CA that tethers' client certificates must be signed by, setting it makes client certificates mandatory
+	CertFile     string `json:"certFile,omitempty"`
+	KeyFile      string `json:"keyFile,omitempty"`
+	ClientCaCert string `json:"clientCaCert,omitempty"`
+
+	// tun only: the device's name (default "teleport0") & mtu (default: the device's)
+	Device string `json:"device,omitempty"`
+	Mtu    int    `json:"mtu,omitempty"`
+
+	// socks5 & tun only: udp associations (flows) which passed no datagrams for this long are closed (default 60), the exit node closes them after the same time
+	UdpIdleTimeoutSecs int `json:"udpIdleTimeoutSecs,omitempty"`
+
+	// forward only: the node which listens on the port (bound to localhost with acceptLocalOnly),
+	// and the host:port its connections are tunneled back to, which this node connects to
+	// portForward: the host:port every connection is routed to
+	RemoteNode string `json:"remoteNode,omitempty"`
+	Target     string `json:"target,omitempty"`
 }
 
 // type AuthClient struct {
@@ -20,6 +52,26 @@ type TetherConfig struct {
 	ConnectionName string     `json:"connectionName"`
 	Proxy          *ProxyInfo `json:"proxy,omitempty"`
 	ClientPassword string     `json:"password"`
+	Path           string     `json:"path,omitempty"` // http path of a ws/wss relay, default "/"
+
+	// keepalive pings sent on every physical connection of the tether, zero interval disables them
+	HeartbeatIntervalSecs int `json:"heartbeatIntervalSecs,omitempty"`
+	HeartbeatTimeoutSecs  int `json:"heartbeatTimeoutSecs,omitempty"`
+
+	// how streams are spread over the physical connections: round-robin, least-streams (default), lowest-rtt or least-bytes
+	Scheduling string `json:"scheduling,omitempty"`
+
+	// verification of the relay's certificate, against a CA bundle and/or a pinned sha256 fingerprint of the certificate,
+	// with neither it's verified against the system's roots. insecure skips the chain verification (a pinned fingerprint is still checked)
+	// serverName overrides the name checked against the certificate (default: host)
+	CaCert      string `json:"caCert,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Insecure    bool   `json:"insecure,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+
+	// a client certificate presented to relays which require one
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
 }
 
 type AgentConfig struct {
@@ -28,9 +80,63 @@ type AgentConfig struct {
 	NetworkConfiguration ClientConfig     `json:"netConf"`
 	Proxy                *ProxyInfo       `json:"proxy,omitempty"`
 	NumConnsPerTether    int              `json:"numConnsPerTether"`
+
+	// the node's own certificate, served by relay listeners which don't configure one of their own
+	// it is generated on first run, relative paths are relative to the config file (default: server.crt/server.key)
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
 }
 type ClientConfig struct {
-	Secret   string            `json:"secret"`
+	Secret   string            `json:"secret,omitempty"` // never sent, tethers authenticate with a challenge-response handshake
 	ClientId string            `json:"clientId"`
-	Mapping  map[string]string `json:"networkMapping"` // "<ip or domain>" : "<clientId>"
+	Routes   []RouteConfig     `json:"routes,omitempty"` // evaluated in order, the first matching route is taken
+	Mapping  map[string]string `json:"networkMapping"`   // legacy: "<ip or domain>" : "<clientId>", evaluated after routes
+
+	// destinations served by this node, advertised to peers which route them here without any configuration
+	// same syntax as networkMapping keys: "*.corp.com", "10.0.0.0/8", "10.0.0.0/8:22"
+	NetworkExports []string `json:"networkExports,omitempty"`
+	// per peer exports ("<clientId>": [...]), replacing networkExports for that peer
+	// once any exports are configured, relayed tasks are only executed for exported destinations
+	PeerExports map[string][]string `json:"peerExports,omitempty"`
+
+	MaxHops int `json:"maxHops,omitempty"` // tasks which went through more relays are refused (default: 16)
+
+	// ports other nodes may open here with forward listeners: "<clientId>" (or "*" for any node): ["8080", "9000-9100"]
+	// no node can open a port unless it's configured
+	ForwardPorts map[string][]string `json:"forwardPorts,omitempty"`
+}
+
+// RouteConfig is a single routing rule, it matches targets by one of host (a glob), regex or cidr, and optionally by ports
+// the action is one of: local, tether:<clientId>, reject, direct-via-proxy
+// fallback next hops are tried in order when the tether of the action is not connected,
+// unless the rule is "weighted": flows are then spread over its tether next hops, the other next hops are tried last
+type RouteConfig struct {
+	Comment  string         `json:"comment,omitempty"`
+	Host     string         `json:"host,omitempty"`
+	Regex    string         `json:"regex,omitempty"`
+	Cidr     string         `json:"cidr,omitempty"`
+	Ports    string         `json:"ports,omitempty"` // "443" or "8000-8100"
+	Action   string         `json:"action"`
+	Fallback []string       `json:"fallback,omitempty"`
+	Balance  string         `json:"balance,omitempty"` // "failover" (default) or "weighted"
+	Weights  map[string]int `json:"weights,omitempty"` // "<clientId>": weight, of the tether next hops of a weighted rule (default 1)
+	Sticky   bool           `json:"sticky,omitempty"`  // weighted: a client address keeps its next hop for as long as it's up
+}
+
+// how a rule chooses between its next hops
+const (
+	BalanceFailover = "failover" // the first next hop which is available
+	BalanceWeighted = "weighted" // each flow takes one of the available tethers, with a probability proportional to its weight
+)
+
+// String describes the route for logging
+func (rc *RouteConfig) String() string {
+	match := rc.Host + rc.Regex + rc.Cidr
+	if match == "" {
+		match = "*"
+	}
+	if rc.Ports != "" {
+		match += " ports " + rc.Ports
+	}
+	return match + " -> " + rc.Action
 }
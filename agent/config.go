@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 
-	"github.com/amitbet/teleporter/logger"
+	"teleporter/logger"
 )
 
 type config struct {
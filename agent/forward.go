@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"teleporter/logger"
+)
+
+// a reverse forward publishes a service reachable from this node on a port of a remote node:
+// this node sends a forward task to the remote node, carrying the target, and keeps it open for as long as the port
+// should be served. the remote node answers with a status once it listens, and routes every connection it accepts
+// back to us as a plain tcp task addressed to this node, which then connects it to the target.
+
+// forwardRequest follows the header of a forward task
+type forwardRequest struct {
+	Port      int  `json:"port"`
+	LocalOnly bool `json:"localOnly,omitempty"` // bind the port to localhost
+}
+
+// splitForwardTarget splits the "host:port" target of a forward or portForward listener, the port has to be a real one
+func splitForwardTarget(target string) (string, string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", err
+	}
+	if intPort, err := strconv.Atoi(port); err != nil || intPort < 1 || intPort > 65535 {
+		return "", "", errors.New("bad port: " + port)
+	}
+	return host, port, nil
+}
+
+// startReverseForward checks a forward listener's configuration and keeps its port open on the remote node
+func (rtr *Router) startReverseForward(conf ListenerConfig) error {
+	if conf.RemoteNode == "" || conf.RemoteNode == rtr.NetworkConfig.ClientId {
+		return errors.New("forward listener needs a remoteNode other than this node")
+	}
+	if conf.Port <= 0 || conf.Port > 65535 {
+		return errors.New("bad port for forward listener: " + strconv.Itoa(conf.Port))
+	}
+	host, port, err := splitForwardTarget(conf.Target)
+	if err != nil {
+		return errors.New("bad target for forward listener: " + conf.Target)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String() // the form it takes in task headers
+	}
+	conf.Target = net.JoinHostPort(host, port)
+
+	rtr.mu.Lock()
+	rtr.forwards = append(rtr.forwards, conf)
+	rtr.mu.Unlock()
+	go rtr.keepReverseForward(conf, host, port)
+	return nil
+}
+
+// keepReverseForward opens the forward again whenever it's dropped, e.g. when the tether to the remote node reconnects
+func (rtr *Router) keepReverseForward(conf ListenerConfig, host, port string) {
+	bo := &backoff{min: time.Second, max: time.Minute}
+	for {
+		opened, err := rtr.openReverseForward(conf, host, port)
+		if opened {
+			bo.Reset()
+		}
+		logger.Warn("Router.keepReverseForward: port ", conf.Port, " on ", conf.RemoteNode, " is not forwarded: ", err)
+		time.Sleep(bo.Next())
+	}
+}
+
+// openReverseForward routes a forward task to the remote node and holds it until it's dropped,
+// it tells if the remote node listened on the port at some point
+func (rtr *Router) openReverseForward(conf ListenerConfig, host, port string) (bool, error) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go rtr.route(NewTunnelTask(remote, &TaskInfo{
+		Type:          TaskTypeForward,
+		TargetAddress: host,
+		TargetPort:    port,
+		TargetNode:    conf.RemoteNode,
+		Local:         true,
+	}))
+
+	// a refused task answers before it reads the request
+	go writeJsonMessage(local, &forwardRequest{Port: conf.Port, LocalOnly: conf.LocalOnly})
+	status, err := readTaskStatus(local)
+	if err != nil {
+		return false, err
+	}
+	if status.Rep != socks5Success {
+		return false, errors.New("refused by " + status.Node + ": " + status.Reason)
+	}
+	logger.Info("Router.openReverseForward: ", conf.RemoteNode, " forwards port ", conf.Port, " to ", conf.Target)
+
+	io.Copy(io.Discard, local)
+	return true, errors.New("the forward was closed")
+}
+
+// listenForward serves a forward task: listens on the requested port for as long as the task is open
+func (rtr *Router) listenForward(task *TunnelTask) {
+	defer task.Close()
+	if task.Peer == "" || len(task.Header.Path) == 0 {
+		rtr.refuseTask(task, socks5RuleFailure, "forwards are only opened for other nodes")
+		return
+	}
+	// forwards are only opened for direct peers: the relays of a longer path could name any node as its origin,
+	// and forwardPorts grants ports by the origin's id
+	if len(task.Header.Path) != 1 || task.Header.Path[0] != task.Peer {
+		rtr.refuseTask(task, socks5RuleFailure, "forwards are only opened for directly connected nodes")
+		return
+	}
+	origin := task.Peer
+
+	req := forwardRequest{}
+	err := readJsonMessage(task, &req)
+	if err != nil {
+		logger.Error("Router.listenForward: bad forward request from ", origin, ": ", err)
+		return
+	}
+	if !rtr.forwardAllowed(origin, req.Port) {
+		logger.Warn("Router.listenForward: ", origin, " may not open port ", req.Port)
+		rtr.refuseTask(task, socks5RuleFailure, "port "+strconv.Itoa(req.Port)+" is not allowed")
+		return
+	}
+
+	listenAddr := ":" + strconv.Itoa(req.Port)
+	if req.LocalOnly {
+		listenAddr = "localhost" + listenAddr
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		logger.Error("Router.listenForward: problem with listening to port: ", req.Port, err)
+		rtr.refuseTask(task, socks5ServerFailure, err.Error())
+		return
+	}
+	defer listener.Close()
+	err = rtr.replyTask(task, socks5Success, listener.Addr(), "")
+	if err != nil {
+		return
+	}
+	logger.Info("Router.listenForward: forwarding port ", req.Port, " to ", task.Header.TargetAddress+":"+task.Header.TargetPort, " through ", origin)
+
+	// the port is closed once the origin drops the task
+	go func() {
+		io.Copy(io.Discard, task)
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Info("Router.listenForward: closed forward of port ", req.Port, ": ", err)
+			return
+		}
+		go rtr.route(NewTunnelTask(conn, &TaskInfo{
+			Type:          TaskTypeTcp,
+			TargetAddress: task.Header.TargetAddress,
+			TargetPort:    task.Header.TargetPort,
+			TargetNode:    origin,
+			Local:         true,
+		}))
+	}
+}
+
+// forwardAllowed tells if a node may open a port on this node, by the node's own entry in forwardPorts or by "*"
+func (rtr *Router) forwardAllowed(nodeId string, port int) bool {
+	rtr.mu.RLock()
+	allowed := rtr.NetworkConfig.ForwardPorts
+	rtr.mu.RUnlock()
+	for _, ranges := range [][]string{allowed[nodeId], allowed["*"]} {
+		for _, ports := range ranges {
+			min, max, err := parsePortRange(ports)
+			if err != nil {
+				logger.Warn("Router.forwardAllowed: ", err)
+				continue
+			}
+			if min == 0 || (port >= min && port <= max) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isOwnForward tells if a tcp task is a connection to one of our reverse forwards, coming back from its remote node
+func (rtr *Router) isOwnForward(taskInf *TaskInfo) bool {
+	if len(taskInf.Path) == 0 {
+		return false
+	}
+	target := net.JoinHostPort(taskInf.TargetAddress, taskInf.TargetPort)
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	for _, conf := range rtr.forwards {
+		if conf.RemoteNode == taskInf.Path[0] && conf.Target == target {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePortForwardListener routes every accepted connection to the listener's fixed target, as if a socks5 client
+// asked for it, so the routing rules decide which tether carries it
+func (rtr *Router) handlePortForwardListener(listener net.Listener, host, port string) {
+	defer listener.Close()
+	logger.Info("Started new port forward listener at ", listener.Addr().String(), " to ", net.JoinHostPort(host, port))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Error("Closed port forward listener: ", err)
+			return
+		}
+		srcHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		go rtr.route(NewTunnelTask(conn, &TaskInfo{
+			Type:          TaskTypeTcp,
+			TargetAddress: host,
+			TargetPort:    port,
+			Local:         true,
+			Source:        srcHost,
+		}))
+	}
+}
@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runEchoServer serves an echo on a random local port
+func runEchoServer(t *testing.T) string {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %s", err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	return echo.Addr().String()
+}
+
+func TestReverseForward(t *testing.T) {
+	relayPass := GenerateRandomString(32)
+	echoAddr := runEchoServer(t)
+
+	cloud := NewRouter()
+	cloud.NetworkConfig.ClientId = "fwdCloud"
+	cloud.NetworkConfig.ForwardPorts = map[string][]string{"fwdOnPrem": {"10412"}}
+	err := cloud.Serve(ListenerConfig{
+		Port:              10411,
+		Type:              "relayTcp",
+		UseAuthentication: true,
+		AuthorizedClients: map[string]string{"fwdOnPrem": relayPass},
+	})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	onPrem := NewRouter()
+	onPrem.NetworkConfig.ClientId = "fwdOnPrem"
+	err = onPrem.Connect(&TetherConfig{
+		TargetPort:     10411,
+		TargetHost:     "localhost",
+		ConnectionType: "tls",
+		Insecure:       true,
+		ClientPassword: relayPass,
+	}, 2)
+	if err != nil {
+		t.Fatalf("failed to connect tether: %s", err)
+	}
+	if err := onPrem.Serve(ListenerConfig{Type: "forward", Port: 10412, RemoteNode: "fwdCloud", Target: echoAddr}); err != nil {
+		t.Fatalf("failed to start forward listener: %s", err)
+	}
+
+	// the port opens on the cloud node, and its connections reach the on-prem echo server
+	var conn net.Conn
+	deadline := time.Now().Add(10 * time.Second)
+	for conn == nil {
+		conn, err = net.Dial("tcp", "127.0.0.1:10412")
+		if err != nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("forwarded port was never opened: %s", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("through the forward"))
+	buf := make([]byte, len("through the forward"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "through the forward" {
+		t.Fatalf("bad echo through the forward: %q %v", buf, err)
+	}
+
+	// ports which weren't allowed stay closed
+	_, err = onPrem.openReverseForward(ListenerConfig{Port: 10413, RemoteNode: "fwdCloud"}, "127.0.0.1", "22")
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("a port which isn't allowed should be refused, got: %v", err)
+	}
+
+	// the on-prem node only connects to targets it forwards itself
+	if onPrem.isOwnForward(&TaskInfo{TargetAddress: "127.0.0.1", TargetPort: "22", Path: []string{"fwdCloud"}}) {
+		t.Errorf("a target which isn't forwarded should be refused")
+	}
+	for _, conf := range []ListenerConfig{
+		{Type: "forward", Port: 10414, Target: echoAddr},
+		{Type: "forward", Port: 10414, RemoteNode: "fwdCloud", Target: "nowhere"},
+		{Type: "forward", Port: 10414, RemoteNode: "fwdCloud", Target: "127.0.0.1:99999"},
+	} {
+		if err := onPrem.Serve(conf); err == nil {
+			t.Errorf("a bad forward listener was accepted: %+v", conf)
+		}
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	relayPass := GenerateRandomString(32)
+	echoAddr := runEchoServer(t)
+
+	exit := NewRouter()
+	exit.NetworkConfig.ClientId = "pfExit"
+	exit.NetworkConfig.Mapping["*"] = "local"
+	err := exit.Serve(ListenerConfig{
+		Port:              10422,
+		Type:              "relayTcp",
+		UseAuthentication: true,
+		AuthorizedClients: map[string]string{"pfEntry": relayPass},
+	})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	entry := NewRouter()
+	entry.NetworkConfig.ClientId = "pfEntry"
+	entry.NetworkConfig.Mapping["*"] = "pfExit"
+	err = entry.Connect(&TetherConfig{
+		TargetPort:     10422,
+		TargetHost:     "localhost",
+		ConnectionType: "tls",
+		Insecure:       true,
+		ClientPassword: relayPass,
+	}, 2)
+	if err != nil {
+		t.Fatalf("failed to connect tether: %s", err)
+	}
+	if err := entry.Serve(ListenerConfig{Type: "portForward", Port: 10421, LocalOnly: true, Target: echoAddr}); err != nil {
+		t.Fatalf("failed to start port forward listener: %s", err)
+	}
+	for _, target := range []string{"nowhere", "host:http", "host:0", "host:70000", "host:"} {
+		if err := entry.Serve(ListenerConfig{Type: "portForward", Port: 10423, Target: target}); err == nil {
+			t.Errorf("a port forward to %q was accepted", target)
+		}
+	}
+
+	// the connection is routed by the mapping through the exit node, with no socks5 negotiation on the way
+	conn, err := net.Dial("tcp", "127.0.0.1:10421")
+	if err != nil {
+		t.Fatalf("failed to connect to the port forward: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("through the port forward"))
+	buf := make([]byte, len("through the port forward"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "through the port forward" {
+		t.Fatalf("bad echo through the port forward: %q %v", buf, err)
+	}
+}
+
+func TestForwardOriginIsThePeer(t *testing.T) {
+	rtr := NewRouter()
+	rtr.NetworkConfig.ClientId = "fwdRelay"
+	rtr.NetworkConfig.ForwardPorts = map[string][]string{"trusted": {"*"}}
+
+	open := func(peer string, path []string) *taskStatus {
+		local, remote := net.Pipe()
+		defer local.Close()
+		task := NewTunnelTask(remote, &TaskInfo{Type: TaskTypeForward, TargetAddress: "127.0.0.1", TargetPort: "22", Path: path})
+		task.Peer = peer
+		go rtr.route(task)
+		go writeJsonMessage(local, &forwardRequest{Port: 0, LocalOnly: true})
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		status, err := readTaskStatus(local)
+		if err != nil {
+			t.Fatalf("no status for the forward: %s", err)
+		}
+		return status
+	}
+
+	// a peer naming another node as the origin, or as the last hop, is refused
+	for _, path := range [][]string{{"trusted"}, {"trusted", "someRelay"}, {"trusted", "mallory"}} {
+		if status := open("mallory", path); status.Rep != socks5RuleFailure {
+			t.Errorf("a forward from mallory with path %v should be refused, got: %+v", path, status)
+		}
+	}
+	if status := open("trusted", []string{"trusted"}); status.Rep != socks5Success {
+		t.Errorf("a forward from the node itself should be opened, got: %+v", status)
+	}
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"teleporter/logger"
+)
+
+// the handshake every physical connection starts with, before any configuration is exchanged:
+//   relay -> tether: authChallenge{relay nonce}
+//   tether -> relay: authResponse{clientId, tether nonce, mac(secret, client label, both nonces, clientId)}
+//   relay -> tether: authResult{ok, mac(secret, server label, both nonces, clientId)}
+// the secret itself never crosses the wire, and the tether learns that the relay knows it too
+
+const authNonceSize = 32
+
+var (
+	authClientLabel = []byte("teleporter client auth v1")
+	authServerLabel = []byte("teleporter server auth v1")
+)
+
+type authChallenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
+type authResponse struct {
+	ClientId string `json:"clientId"`
+	Nonce    []byte `json:"nonce"`
+	Mac      []byte `json:"mac"`
+}
+
+type authResult struct {
+	Ok  bool   `json:"ok"`
+	Mac []byte `json:"mac,omitempty"` // empty when the relay does not authenticate its clients
+}
+
+// authMac computes the proof of knowing the secret, all parts are length prefixed so they can't be shifted around
+func authMac(secret string, label []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(label)
+	for _, p := range parts {
+		binary.Write(mac, binary.BigEndian, uint32(len(p)))
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+func newAuthNonce() ([]byte, error) {
+	nonce := make([]byte, authNonceSize)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	return nonce, err
+}
+
+func writeJsonMessage(w io.Writer, msg interface{}) error {
+	jstr, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return WriteString(w, string(jstr))
+}
+
+func readJsonMessage(r io.Reader, msg interface{}) error {
+	str, err := ReadLimitedString(r, maxJsonMessageSize)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(str), msg)
+}
+
+// authenticateClient runs the relay side of the handshake and returns the authenticated clientId,
+// when the listener doesn't use authentication any client is accepted under the id it claims
+func authenticateClient(conn io.ReadWriter, serverConf *ListenerConfig) (string, error) {
+	serverNonce, err := newAuthNonce()
+	if err != nil {
+		return "", err
+	}
+	err = writeJsonMessage(conn, &authChallenge{Nonce: serverNonce})
+	if err != nil {
+		return "", err
+	}
+
+	resp := authResponse{}
+	err = readJsonMessage(conn, &resp)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Nonce) != authNonceSize {
+		writeJsonMessage(conn, &authResult{Ok: false})
+		return "", errors.New("authenticateClient: bad client nonce from: " + resp.ClientId)
+	}
+
+	if !serverConf.UseAuthentication {
+		return resp.ClientId, writeJsonMessage(conn, &authResult{Ok: true})
+	}
+
+	secret, ok := serverConf.AuthorizedClients[resp.ClientId]
+	expected := authMac(secret, authClientLabel, serverNonce, resp.Nonce, []byte(resp.ClientId))
+	if !ok || !hmac.Equal(expected, resp.Mac) {
+		writeJsonMessage(conn, &authResult{Ok: false})
+		return "", errors.New("authenticateClient: bad credentials for clientId: " + resp.ClientId)
+	}
+
+	proof := authMac(secret, authServerLabel, serverNonce, resp.Nonce, []byte(resp.ClientId))
+	return resp.ClientId, writeJsonMessage(conn, &authResult{Ok: true, Mac: proof})
+}
+
+// authenticateToServer runs the tether side of the handshake, proving we know the secret & checking that the relay does too
+func authenticateToServer(conn io.ReadWriter, clientId, secret string) error {
+	challenge := authChallenge{}
+	err := readJsonMessage(conn, &challenge)
+	if err != nil {
+		return err
+	}
+	if len(challenge.Nonce) != authNonceSize {
+		return errors.New("authenticateToServer: bad nonce in relay challenge")
+	}
+
+	clientNonce, err := newAuthNonce()
+	if err != nil {
+		return err
+	}
+	err = writeJsonMessage(conn, &authResponse{
+		ClientId: clientId,
+		Nonce:    clientNonce,
+		Mac:      authMac(secret, authClientLabel, challenge.Nonce, clientNonce, []byte(clientId)),
+	})
+	if err != nil {
+		return err
+	}
+
+	result := authResult{}
+	err = readJsonMessage(conn, &result)
+	if err != nil {
+		return err
+	}
+	if !result.Ok {
+		return errors.New("authenticateToServer: the relay refused our credentials")
+	}
+	if len(result.Mac) == 0 {
+		logger.Warn("authenticateToServer: the relay does not authenticate its clients, it can't prove its identity")
+		return nil
+	}
+	expected := authMac(secret, authServerLabel, challenge.Nonce, clientNonce, []byte(clientId))
+	if !hmac.Equal(expected, result.Mac) {
+		return errors.New("authenticateToServer: the relay failed to prove it knows our secret")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// runHandshake runs both sides of the handshake over a pipe and returns the relay's & the tether's results
+func runHandshake(serverConf *ListenerConfig, clientId, secret string) (string, error, error) {
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	type result struct {
+		cid string
+		err error
+	}
+	srvResult := make(chan result, 1)
+	go func() {
+		cid, err := authenticateClient(srvConn, serverConf)
+		if err != nil {
+			srvConn.Close()
+		}
+		srvResult <- result{cid, err}
+	}()
+
+	cliErr := authenticateToServer(cliConn, clientId, secret)
+	r := <-srvResult
+	return r.cid, r.err, cliErr
+}
+
+func TestChallengeResponse(t *testing.T) {
+	serverConf := &ListenerConfig{
+		UseAuthentication: true,
+		AuthorizedClients: map[string]string{"alice": "alicePass"},
+	}
+
+	cid, srvErr, cliErr := runHandshake(serverConf, "alice", "alicePass")
+	if srvErr != nil || cliErr != nil || cid != "alice" {
+		t.Fatalf("good credentials were refused: %v, %v, %s", srvErr, cliErr, cid)
+	}
+
+	_, srvErr, cliErr = runHandshake(serverConf, "alice", "wrongPass")
+	if srvErr == nil || cliErr == nil {
+		t.Fatalf("a bad secret should fail on both sides: %v, %v", srvErr, cliErr)
+	}
+
+	_, srvErr, cliErr = runHandshake(serverConf, "mallory", "")
+	if srvErr == nil || cliErr == nil {
+		t.Fatalf("an unknown client should fail on both sides: %v, %v", srvErr, cliErr)
+	}
+
+	cid, srvErr, cliErr = runHandshake(&ListenerConfig{}, "bob", "anything")
+	if srvErr != nil || cliErr != nil || cid != "bob" {
+		t.Fatalf("a relay without authentication should accept anyone: %v, %v", srvErr, cliErr)
+	}
+}
+
+func TestRelayProvesItsIdentity(t *testing.T) {
+	// a relay that doesn't know the secret can't fake the proof it sends back
+	srvConn, cliConn := net.Pipe()
+	defer cliConn.Close()
+	go func() {
+		defer srvConn.Close()
+		nonce, _ := newAuthNonce()
+		writeJsonMessage(srvConn, &authChallenge{Nonce: nonce})
+		resp := authResponse{}
+		readJsonMessage(srvConn, &resp)
+		writeJsonMessage(srvConn, &authResult{Ok: true, Mac: authMac("guess", authServerLabel, nonce, resp.Nonce, []byte(resp.ClientId))})
+	}()
+
+	if err := authenticateToServer(cliConn, "alice", "alicePass"); err == nil {
+		t.Fatalf("a relay with a wrong proof should be refused")
+	}
+}
+
+func TestNetConfigOnlyCarriesTheId(t *testing.T) {
+	private := func(rtr *Router, id string) {
+		rtr.NetworkConfig.ClientId = id
+		rtr.NetworkConfig.Mapping["*.corp.com"] = "bastion"
+		rtr.NetworkConfig.NetworkExports = []string{"10.0.0.0/8"}
+		rtr.NetworkConfig.PeerExports = map[string][]string{"someoneElse": {"10.1.0.0/16"}}
+		rtr.NetworkConfig.ForwardPorts = map[string][]string{"*": {"8080"}}
+	}
+	leaked := func(conf *ClientConfig) bool {
+		return len(conf.Mapping) > 0 || len(conf.Routes) > 0 || conf.NetworkExports != nil || conf.PeerExports != nil || conf.ForwardPorts != nil
+	}
+
+	relay := NewRouter()
+	private(relay, "netConfRelay")
+	err := relay.Serve(ListenerConfig{Port: 10451, Type: "relayTcp"})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+	cli := NewRouter()
+	private(cli, "netConfClient")
+
+	conn, relayConf, _, err := cli.dialTetherConn("localhost:10451", &TetherConfig{ConnectionType: "tls", Insecure: true})
+	if err != nil {
+		t.Fatalf("failed to dial the relay: %s", err)
+	}
+	defer conn.Close()
+	if relayConf.ClientId != "netConfRelay" || leaked(relayConf) {
+		t.Errorf("the relay should only send its id, got: %+v", relayConf)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		relay.mu.RLock()
+		teth := relay.tethers["netConfClient"]
+		var cliConf *ClientConfig
+		if teth != nil {
+			cliConf = teth.RemoteConfig
+		}
+		relay.mu.RUnlock()
+		if cliConf != nil {
+			if leaked(cliConf) {
+				t.Errorf("the tether should only send its id, got: %+v", cliConf)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the relay never registered the tether")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
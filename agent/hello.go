@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Version is the software version of this build, set with: go build -ldflags "-X teleporter/agent.Version=1.2.3"
+var Version = "dev"
+
+// after authenticating, both sides of a physical connection exchange hello messages (the relay first):
+// each side announces the range of protocol versions it speaks and its capabilities, both then independently
+// agree on the highest common version and on the capabilities they have in common.
+// the tether's side also reports a failed negotiation in its hello, so the relay can log why it was refused.
+// version 1 was the net config announcement of the first binary task header, such peers are refused cleanly.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 2
+)
+
+// capabilities a node may support, a feature is only used on a tether when both sides announce it
+const (
+	capCompression  = "compression"   // compressed streams (no node supports it yet)
+	capUdp          = "udp"           // udp associate flows
+	capKeepalive    = "keepalive"     // answering heartbeat pings
+	capRouteAdverts = "route-adverts" // dynamic route propagation
+	capForward      = "forward"       // reverse forwards & plain tcp tasks
+)
+
+// localCapabilities are the capabilities this build announces
+var localCapabilities = []string{capUdp, capKeepalive, capRouteAdverts, capForward}
+
+type helloMessage struct {
+	ProtocolVersion    int      `json:"protocolVersion"`
+	MinProtocolVersion int      `json:"minProtocolVersion"`
+	SoftwareVersion    string   `json:"softwareVersion"`
+	Capabilities       []string `json:"capabilities"`
+	Error              string   `json:"error,omitempty"` // why the sender refuses the connection
+}
+
+// Features is what was agreed on with the node on the other side of a tether
+type Features struct {
+	ProtocolVersion int
+	SoftwareVersion string // the remote node's
+	Capabilities    []string
+}
+
+// Has tells if both sides support a capability, nothing is supported before a negotiation
+func (f *Features) Has(capability string) bool {
+	if f == nil {
+		return false
+	}
+	for _, c := range f.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func localHello() *helloMessage {
+	return &helloMessage{
+		ProtocolVersion:    protocolVersion,
+		MinProtocolVersion: minProtocolVersion,
+		SoftwareVersion:    Version,
+		Capabilities:       localCapabilities,
+	}
+}
+
+// negotiate agrees on the highest common protocol version and the common capabilities,
+// the result is the same on both sides
+func negotiate(local, remote *helloMessage) (*Features, error) {
+	if remote.Error != "" {
+		return nil, errors.New("peer refused the connection: " + remote.Error)
+	}
+	version := local.ProtocolVersion
+	if remote.ProtocolVersion < version {
+		version = remote.ProtocolVersion
+	}
+	if version < local.MinProtocolVersion || version < remote.MinProtocolVersion {
+		return nil, errors.New("incompatible protocol versions, we speak " + versionRange(local) +
+			", the peer (" + remote.SoftwareVersion + ") speaks " + versionRange(remote))
+	}
+
+	features := &Features{ProtocolVersion: version, SoftwareVersion: remote.SoftwareVersion}
+	for _, c := range local.Capabilities {
+		for _, rc := range remote.Capabilities {
+			if c == rc {
+				features.Capabilities = append(features.Capabilities, c)
+				break
+			}
+		}
+	}
+	return features, nil
+}
+
+func versionRange(h *helloMessage) string {
+	if h.MinProtocolVersion == h.ProtocolVersion || h.MinProtocolVersion == 0 {
+		return "version " + strconv.Itoa(h.ProtocolVersion)
+	}
+	return "versions " + strconv.Itoa(h.MinProtocolVersion) + "-" + strconv.Itoa(h.ProtocolVersion)
+}
+
+// helloAsRelay sends our hello first, then reads the tether's
+func helloAsRelay(conn io.ReadWriter) (*Features, error) {
+	local := localHello()
+	err := writeJsonMessage(conn, local)
+	if err != nil {
+		return nil, err
+	}
+	remote := helloMessage{}
+	err = readJsonMessage(conn, &remote)
+	if err != nil {
+		return nil, err
+	}
+	return negotiate(local, &remote)
+}
+
+// helloAsTether reads the relay's hello and answers it, telling the relay when the negotiation failed
+func helloAsTether(conn io.ReadWriter) (*Features, error) {
+	local := localHello()
+	remote := helloMessage{}
+	err := readJsonMessage(conn, &remote)
+	if err != nil {
+		return nil, err
+	}
+	features, negErr := negotiate(local, &remote)
+	if negErr != nil {
+		local.Error = negErr.Error()
+	}
+	err = writeJsonMessage(conn, local)
+	if negErr != nil {
+		return nil, negErr
+	}
+	return features, err
+}
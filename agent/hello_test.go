@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	newer := &helloMessage{ProtocolVersion: 3, MinProtocolVersion: 2, SoftwareVersion: "2.0", Capabilities: []string{capCompression, capUdp, capKeepalive}}
+	older := &helloMessage{ProtocolVersion: 2, MinProtocolVersion: 2, SoftwareVersion: "1.0", Capabilities: []string{capUdp, capKeepalive, capRouteAdverts}}
+
+	// both sides agree on the same thing
+	a, errA := negotiate(newer, older)
+	b, errB := negotiate(older, newer)
+	if errA != nil || errB != nil {
+		t.Fatalf("compatible versions failed to negotiate: %v, %v", errA, errB)
+	}
+	if a.ProtocolVersion != 2 || b.ProtocolVersion != 2 {
+		t.Errorf("expected the highest common version 2, got: %d, %d", a.ProtocolVersion, b.ProtocolVersion)
+	}
+	if !reflect.DeepEqual(a.Capabilities, b.Capabilities) || !a.Has(capUdp) || !a.Has(capKeepalive) || a.Has(capCompression) || a.Has(capRouteAdverts) {
+		t.Errorf("expected only the common capabilities, got: %v, %v", a.Capabilities, b.Capabilities)
+	}
+
+	tooNew := &helloMessage{ProtocolVersion: 5, MinProtocolVersion: 4}
+	if _, err := negotiate(older, tooNew); err == nil {
+		t.Errorf("versions without overlap should be refused")
+	}
+	if _, err := negotiate(older, &helloMessage{Error: "go away"}); err == nil {
+		t.Errorf("a peer's refusal should fail the negotiation")
+	}
+
+	var none *Features
+	if none.Has(capUdp) {
+		t.Errorf("nothing is supported before a negotiation")
+	}
+}
+
+func TestHelloExchange(t *testing.T) {
+	exchange := func(relayHello *helloMessage) (*Features, error, error) {
+		srvConn, cliConn := net.Pipe()
+		defer srvConn.Close()
+		defer cliConn.Close()
+		srvErr := make(chan error, 1)
+		go func() {
+			if relayHello == nil {
+				_, err := helloAsRelay(srvConn)
+				srvErr <- err
+				return
+			}
+			writeJsonMessage(srvConn, relayHello)
+			reply := helloMessage{}
+			err := readJsonMessage(srvConn, &reply)
+			if err == nil {
+				_, err = negotiate(relayHello, &reply)
+			}
+			srvErr <- err
+		}()
+		features, cliErr := helloAsTether(cliConn)
+		return features, <-srvErr, cliErr
+	}
+
+	features, srvErr, cliErr := exchange(nil)
+	if srvErr != nil || cliErr != nil || features.ProtocolVersion != protocolVersion || !features.Has(capRouteAdverts) {
+		t.Fatalf("two nodes of this build should agree on everything: %v %v %v", features, srvErr, cliErr)
+	}
+
+	// a relay on the first binary protocol sends its net config where the hello is expected
+	_, srvErr, cliErr = exchange(&helloMessage{ProtocolVersion: 1, MinProtocolVersion: 0})
+	if srvErr == nil || cliErr == nil {
+		t.Fatalf("an old relay should be refused on both sides: %v, %v", srvErr, cliErr)
+	}
+}
@@ -0,0 +1,211 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"teleporter/logger"
+)
+
+// an httpProxy listener serves clients which honour HTTP_PROXY / HTTPS_PROXY but can't speak socks5:
+// CONNECT requests & plain requests with an absolute URI are turned into socks tasks to the requested host,
+// which are routed like any other, only the answers to the client are http statuses instead of socks5 replies.
+// plain requests are served one per client connection, each of them is sent to its target with "Connection: close".
+
+// httpProxyHandshakeTimeout bounds the wait for a client's request
+const httpProxyHandshakeTimeout = 30 * time.Second
+
+// handleHttpProxyListener accepts http proxy clients, authenticating them with the listener's authClients if configured
+func (rtr *Router) handleHttpProxyListener(listener net.Listener, serverConf *ListenerConfig) {
+	defer listener.Close()
+	logger.Infof("Started new http proxy listener at port %v\n", listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Error("Closed http proxy listener: ", err)
+			return
+		}
+		go rtr.handleHttpProxyConnection(conn, serverConf)
+	}
+}
+
+func (rtr *Router) handleHttpProxyConnection(conn net.Conn, serverConf *ListenerConfig) {
+	conn.SetReadDeadline(time.Now().Add(httpProxyHandshakeTimeout))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		logger.Error("Router.handleHttpProxyConnection: bad request: ", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if serverConf.UseAuthentication && !httpProxyAuthorized(req, serverConf.AuthorizedClients) {
+		logger.Warn("Router.handleHttpProxyConnection: refusing unauthenticated client: ", conn.RemoteAddr())
+		writeHttpStatus(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"teleporter\"\r\n")
+		conn.Close()
+		return
+	}
+
+	host, port, ok := httpProxyTarget(req)
+	if !ok {
+		logger.Error("Router.handleHttpProxyConnection: no target host in request for: ", req.RequestURI)
+		writeHttpStatus(conn, http.StatusBadRequest, "")
+		conn.Close()
+		return
+	}
+	srcHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	header := &TaskInfo{
+		Type:          TaskTypeSocks,
+		TargetAddress: host,
+		TargetPort:    port,
+		Local:         true,
+		Source:        srcHost,
+	}
+
+	if req.Method == http.MethodConnect {
+		// whatever the client sent right after its request belongs to the tunnel
+		client := conn
+		if br.Buffered() > 0 {
+			client = &bufferedConn{Conn: conn, r: br}
+		}
+		task := NewTunnelTask(client, header)
+		task.clientReply = func(rep uint8, bind net.Addr) error {
+			if rep != socks5Success {
+				return writeHttpStatus(conn, httpStatusFor(rep), "")
+			}
+			_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			return err
+		}
+		rtr.route(task)
+		return
+	}
+	rtr.forwardHttpRequest(conn, req, header)
+}
+
+// forwardHttpRequest routes a task for a plain http request, sends it the request and passes the response back
+func (rtr *Router) forwardHttpRequest(conn net.Conn, req *http.Request, header *TaskInfo) {
+	defer conn.Close()
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	replied := make(chan uint8, 1)
+	task := NewTunnelTask(remote, header)
+	task.clientReply = func(rep uint8, bind net.Addr) error {
+		replied <- rep
+		return nil
+	}
+	routed := make(chan struct{})
+	go func() {
+		rtr.route(task)
+		close(routed)
+	}()
+
+	select {
+	case rep := <-replied:
+		if rep != socks5Success {
+			writeHttpStatus(conn, httpStatusFor(rep), "")
+			return
+		}
+	case <-routed:
+		writeHttpStatus(conn, http.StatusBadGateway, "")
+		return
+	}
+
+	// the request goes out in origin form, without what was meant for the proxy
+	req.RequestURI = ""
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Close = true
+	go func() {
+		err := req.Write(local)
+		if err != nil {
+			logger.Error("Router.forwardHttpRequest: failed sending request to: ", req.Host, err)
+			local.Close()
+		}
+	}()
+	io.Copy(conn, local)
+}
+
+// httpProxyTarget extracts the target of a CONNECT request (host:port) or of a request with an absolute URI
+func httpProxyTarget(req *http.Request) (string, string, bool) {
+	hostPort := req.Host
+	defaultPort := "443"
+	if req.Method != http.MethodConnect {
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			return "", "", false
+		}
+		hostPort = req.URL.Host
+		defaultPort = "80"
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = strings.Trim(hostPort, "[]"), defaultPort
+	}
+	return host, port, host != ""
+}
+
+// httpProxyAuthorized checks the Basic credentials of the request against the listener's clients
+func httpProxyAuthorized(req *http.Request, clients map[string]string) bool {
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	expected, known := clients[user]
+	if !ok || !known {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) == 1
+}
+
+// httpStatusFor translates the socks5 reply a task ended with into the status an http proxy answers
+func httpStatusFor(rep uint8) int {
+	switch rep {
+	case socks5Success:
+		return http.StatusOK
+	case socks5RuleFailure:
+		return http.StatusForbidden
+	case socks5TtlExpired:
+		return http.StatusLoopDetected
+	case socks5CmdNotSupported, socks5AddrNotSupported:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadGateway
+}
+
+// writeHttpStatus answers an http proxy client without a body, extraHeaders are complete header lines
+func writeHttpStatus(w io.Writer, status int, extraHeaders string) error {
+	statusLine := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n"
+	_, err := io.WriteString(w, statusLine+extraHeaders+"Content-Length: 0\r\n\r\n")
+	return err
+}
+
+// bufferedConn reads what its reader buffered before reading from the connection itself
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half closes the connection, so proxy() can signal the end of one direction
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpProxyListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain ", r.URL.Path)
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tunneled ", r.URL.Path)
+	}))
+	defer tlsBackend.Close()
+
+	rtr := NewRouter()
+	rtr.NetworkConfig.Routes = []RouteConfig{{Host: "blocked.example", Action: "reject"}}
+	err := rtr.Serve(ListenerConfig{
+		Port:              10431,
+		Type:              "httpProxy",
+		LocalOnly:         true,
+		UseAuthentication: true,
+		AuthorizedClients: map[string]string{"proxyUser": "proxyPass"},
+	})
+	if err != nil {
+		t.Fatalf("failed to start http proxy listener: %s", err)
+	}
+
+	get := func(client *http.Client, target string) (int, string) {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("request to %s through the proxy failed: %s", target, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	proxied := func(user *url.Userinfo) *http.Client {
+		transport := tlsBackend.Client().Transport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: "127.0.0.1:10431", User: user})
+		return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	}
+	client := proxied(url.UserPassword("proxyUser", "proxyPass"))
+
+	if status, body := get(client, backend.URL+"/a"); status != http.StatusOK || body != "plain /a" {
+		t.Errorf("plain request through the proxy: %d %q", status, body)
+	}
+	if status, body := get(client, tlsBackend.URL+"/b"); status != http.StatusOK || body != "tunneled /b" {
+		t.Errorf("CONNECT through the proxy: %d %q", status, body)
+	}
+	if status, _ := get(proxied(url.UserPassword("proxyUser", "wrong")), backend.URL); status != http.StatusProxyAuthRequired {
+		t.Errorf("a bad password should be refused, got: %d", status)
+	}
+
+	// routing failures are answered with http statuses
+	conn, err := net.Dial("tcp", "127.0.0.1:10431")
+	if err != nil {
+		t.Fatalf("failed to connect to the http proxy: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest(http.MethodConnect, "", nil)
+	req.Host = "blocked.example:443"
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("proxyUser:proxyPass")))
+	req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("a rejected target should be answered with 403, got: %v %v", resp, err)
+	}
+}
+
+func TestHttpProxyTarget(t *testing.T) {
+	cases := []struct {
+		request, host, port string
+		ok                  bool
+	}{
+		{"CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n", "example.com", "8443", true},
+		{"CONNECT [fd00::1]:22 HTTP/1.1\r\nHost: [fd00::1]:22\r\n\r\n", "fd00::1", "22", true},
+		{"GET http://example.com/x HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", "80", true},
+		{"GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n", "", "", false}, // not a proxy request
+	}
+	for _, c := range cases {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(c.request)))
+		if err != nil {
+			t.Fatalf("bad test request %q: %s", c.request, err)
+		}
+		host, port, ok := httpProxyTarget(req)
+		if host != c.host || port != c.port || ok != c.ok {
+			t.Errorf("%q: got %s %s %v", c.request, host, port, ok)
+		}
+	}
+}
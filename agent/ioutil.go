@@ -4,8 +4,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"strconv"
 
-	"github.com/amitbet/teleporter/logger"
+	"teleporter/logger"
 )
 
 func ReadUint32(r io.Reader) (uint32, error) {
@@ -58,6 +59,22 @@ func ReadString(r io.Reader) (string, error) {
 	return string(bytes), nil
 }
 
+// ReadLimitedString reads a string like ReadString, refusing strings longer than maxSize instead of allocating them
+func ReadLimitedString(r io.Reader, maxSize int) (string, error) {
+	size, err := ReadUint32(r)
+	if err != nil {
+		return "", err
+	}
+	if size > uint32(maxSize) {
+		return "", errors.New("util.ReadLimitedString: string too long: " + strconv.Itoa(int(size)))
+	}
+	bytes, err := ReadBytes(r, int(size))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
 func WriteString(w io.Writer, str string) error {
 	length := uint32(len(str))
 	err := binary.Write(w, binary.BigEndian, length)
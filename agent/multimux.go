@@ -1,76 +1,174 @@
 package agent
 
 import (
+	"encoding/binary"
+	"errors"
 	"io"
-	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/amitbet/teleporter/logger"
 	"github.com/inconshreveable/muxado"
+	"teleporter/logger"
 )
 
+// physicalConn is a single muxado session in the bundle, along with its health measurements
+type physicalConn struct {
+	muxado.Session
+	rtt      time.Duration
+	lastPong time.Time
+
+	activeStreams int64 // atomic, streams opened or accepted on this connection & not yet closed (pings aside), added under the mux's lock
+	bytesInFlight int64 // atomic, bytes being written to its streams
+	draining      int32 // atomic, set once no new streams should be opened on it, it closes when its last stream does
+}
+
+// ConnStats describes the health of a single physical connection in a bundle
+type ConnStats struct {
+	RemoteAddr string
+	RTT        time.Duration // round trip of the last ping, zero until the first pong arrives
+	LastPong   time.Time
+
+	ActiveStreams int64
+	BytesInFlight int64
+}
+
 // MultiMux is a client for multiple mux channels,
 // it presents a facade which makes multiple channels seem like one channel
 type MultiMux struct {
-	connections           []muxado.Session
+	connections           []*physicalConn
 	sconns                chan net.Conn
+	connLost              chan struct{}
 	isClient              bool
 	mu                    sync.RWMutex
 	heartBeatIntervalSecs int
+	heartBeatTimeoutSecs  int
 	runHeartBeat          bool
+	schedule              scheduler
+	rr                    int // round robin position of the scheduler
+	closed                chan struct{}
+	closeOnce             sync.Once
+	onChange              func()
 }
 
+// ErrMuxClosed is returned by Accept & Open once the multi-mux is closed
+var ErrMuxClosed = errors.New("multimux: closed")
+
 // NewMultiMux creates a new multi connection mux
 func NewMultiMux(isClient bool) *MultiMux {
 	mm := &MultiMux{}
 	mm.sconns = make(chan net.Conn, 16)
+	mm.connLost = make(chan struct{}, 1)
+	mm.closed = make(chan struct{})
 	mm.isClient = isClient
 	mm.mu = sync.RWMutex{}
+	mm.schedule = scheduleLeastStreams
 	return mm
 }
 
-// func (m *MultiMux) AddHeartbeat(sess muxado.Session) {
-// 	conn, err := sess.Open()
-// 	if err != nil {
-// 		logger.Error("problem creating heartbeat ", err)
-// 	}
-// 	conn.Write("Ping")
-// }
+// SetScheduling chooses how new streams are spread over the physical connections, see the Schedule* strategies
+// an empty strategy keeps the default (least-streams)
+func (m *MultiMux) SetScheduling(strategy string) error {
+	if strategy == "" {
+		strategy = ScheduleLeastStreams
+	}
+	schedule, ok := schedulers[strategy]
+	if !ok {
+		return errors.New("unknown stream scheduling strategy: " + strategy)
+	}
+	m.mu.Lock()
+	m.schedule = schedule
+	m.mu.Unlock()
+	return nil
+}
 
-// AddConnection adds a connection to the multi-mux
-func (m *MultiMux) AddConnection(c io.ReadWriteCloser) {
+// SetHeartbeat configures the keepalive pings sent on every physical connection added from now on,
+// a connection which doesn't answer a ping within timeoutSecs is torn down, an interval <= 0 disables pinging
+func (m *MultiMux) SetHeartbeat(intervalSecs, timeoutSecs int) {
+	if timeoutSecs <= 0 {
+		timeoutSecs = intervalSecs
+	}
+	m.mu.Lock()
+	m.heartBeatIntervalSecs = intervalSecs
+	m.heartBeatTimeoutSecs = timeoutSecs
+	m.runHeartBeat = intervalSecs > 0
+	m.mu.Unlock()
+}
+
+// AddConnection adds a connection to the multi-mux, a closed multi-mux refuses it with ErrMuxClosed
+// the connection is left open in that case, unless the multi-mux was closed while the connection was being added
+func (m *MultiMux) AddConnection(c io.ReadWriteCloser) error {
+	select {
+	case <-m.closed:
+		return ErrMuxClosed
+	default:
+	}
+
+	// every session gets its own config, muxado's shared default config is not safe for concurrent session creation
 	var sess muxado.Session
 	if m.isClient {
-		sess = muxado.Client(c, nil)
-		// if m.runHeartBeat {
-		// 	m.AddHeartbeat(sess)
-		// }
-
+		sess = muxado.Client(c, &muxado.Config{})
 	} else {
-		sess = muxado.Server(c, nil)
+		sess = muxado.Server(c, &muxado.Config{})
 	}
+	pc := &physicalConn{Session: sess}
 
-	//m.mu.Lock()
-	m.connections = append(m.connections, sess)
-	//m.mu.Unlock()
+	// the closed check & the append happen under one lock, so Close never misses a connection
+	m.mu.Lock()
+	select {
+	case <-m.closed:
+		m.mu.Unlock()
+		sess.Close()
+		return ErrMuxClosed
+	default:
+	}
+	m.connections = append(m.connections, pc)
+	runHeartBeat := m.runHeartBeat
+	onChange := m.onChange
+	m.mu.Unlock()
 
-	go m.handleSession(sess)
+	go m.handleSession(pc)
+	if runHeartBeat {
+		go m.heartbeat(pc)
+	}
+	if onChange != nil {
+		onChange()
+	}
+	return nil
 }
 
-func (m *MultiMux) handleSession(sess muxado.Session) {
+// SetOnChange sets a function called whenever a physical connection joins or leaves the bundle, or the bundle is closed
+func (m *MultiMux) SetOnChange(fn func()) {
+	m.mu.Lock()
+	m.onChange = fn
+	m.mu.Unlock()
+}
+
+func (m *MultiMux) handleSession(sess *physicalConn) {
 	defer func() {
 		logger.Info("Physical connection ended, removing")
 		//remove at end of session
+		m.mu.Lock()
 		for i, cn := range m.connections {
 			if sess == cn {
-				//TODO: verify that this works and removes the connection, verify thread safety
 				m.connections = append(m.connections[:i], m.connections[i+1:]...)
 				break
 			}
 		}
+		onChange := m.onChange
+		m.mu.Unlock()
 		//close session
 		sess.Close()
+
+		// let whoever maintains the bundle know it has shrunk
+		select {
+		case m.connLost <- struct{}{}:
+		default:
+		}
+		if onChange != nil {
+			onChange()
+		}
 	}()
 
 	for {
@@ -79,24 +177,248 @@ func (m *MultiMux) handleSession(sess muxado.Session) {
 			logger.Error("Can't accept, connection is dead", err)
 			break
 		}
-		m.sconns <- sconn
+		m.mu.Lock()
+		atomic.AddInt64(&sess.activeStreams, 1)
+		m.mu.Unlock()
+		stream := newTrackedStream(sconn, sess)
+		select {
+		case m.sconns <- stream:
+		case <-m.closed:
+			stream.Close()
+			return
+		}
+	}
+}
+
+// heartbeat pings the other side over a dedicated stream on the given session,
+// the remote router echoes every ping back, if it fails to do so in time the physical connection is torn down
+// so that connections silently dropped by NATs or firewalls are detected and replaced
+func (m *MultiMux) heartbeat(sess *physicalConn) {
+	m.mu.RLock()
+	interval := time.Duration(m.heartBeatIntervalSecs) * time.Second
+	timeout := time.Duration(m.heartBeatTimeoutSecs) * time.Second
+	m.mu.RUnlock()
+
+	stream, err := sess.Open()
+	if err != nil {
+		logger.Error("MultiMux.heartbeat: problem opening ping stream: ", err)
+		return
+	}
+	defer stream.Close()
+
+	err = writeTaskInfo(stream, &TaskInfo{Type: TaskTypePing})
+	if err != nil {
+		logger.Error("MultiMux.heartbeat: problem sending ping header: ", err)
+		sess.Close()
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for seq := uint32(1); ; seq++ {
+		<-ticker.C
+		start := time.Now()
+		// muxado streams ignore read deadlines, so the watchdog kills the whole session instead
+		watchdog := time.AfterFunc(timeout, func() {
+			logger.Warnf("MultiMux.heartbeat: no pong from %v within %v, closing physical connection", sess.RemoteAddr(), timeout)
+			sess.Close()
+		})
+
+		err = binary.Write(stream, binary.BigEndian, seq)
+		var pong uint32
+		if err == nil {
+			pong, err = ReadUint32(stream)
+		}
+		watchdog.Stop()
+		if err == nil && pong != seq {
+			err = errors.New("out of order pong")
+		}
+		if err != nil {
+			logger.Warnf("MultiMux.heartbeat: no pong from %v, closing physical connection: %v", sess.RemoteAddr(), err)
+			sess.Close()
+			return
+		}
+
+		m.mu.Lock()
+		sess.rtt = time.Since(start)
+		sess.lastPong = time.Now()
+		m.mu.Unlock()
+	}
+}
+
+// answerPings echoes every ping read from the stream back to the pinging side, until the stream dies
+func answerPings(conn io.ReadWriter) {
+	for {
+		ping, err := ReadUint32(conn)
+		if err != nil {
+			return
+		}
+		err = binary.Write(conn, binary.BigEndian, ping)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Len returns the number of live physical connections in the bundle
+func (m *MultiMux) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.connections)
+}
+
+// Stats returns the health measurements of all live physical connections in the bundle
+func (m *MultiMux) Stats() []ConnStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := make([]ConnStats, 0, len(m.connections))
+	for _, sess := range m.connections {
+		stats = append(stats, ConnStats{
+			RemoteAddr: sess.RemoteAddr().String(),
+			RTT:        sess.rtt,
+			LastPong:   sess.lastPong,
+
+			ActiveStreams: atomic.LoadInt64(&sess.activeStreams),
+			BytesInFlight: atomic.LoadInt64(&sess.bytesInFlight),
+		})
 	}
+	return stats
+}
+
+// ConnectionLost returns a channel which is signaled whenever a physical connection leaves the bundle
+func (m *MultiMux) ConnectionLost() <-chan struct{} {
+	return m.connLost
 }
 
-// Accept returns an incoming client connection or waits until one is initiated
+// Accept returns an incoming client connection or waits until one is initiated, it fails once the multi-mux is closed
 func (m *MultiMux) Accept() (net.Conn, error) {
-	sconn := <-m.sconns
+	select {
+	case sconn := <-m.sconns:
+		return sconn, nil
+	case <-m.closed:
+		return nil, ErrMuxClosed
+	}
+}
+
+// Close closes every physical connection, and makes Accept, Open & AddConnection fail from now on
+func (m *MultiMux) Close() error {
+	var onChange func()
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		close(m.closed)
+		conns := m.connections
+		m.connections = nil
+		onChange = m.onChange
+		m.mu.Unlock()
 
-	return sconn, nil
+		for _, pc := range conns {
+			pc.Close()
+		}
+	})
+	// outside of the once, onChange may well close the multi-mux again
+	if onChange != nil {
+		onChange()
+	}
+	return nil
 }
 
+// Closed returns a channel which is closed when the multi-mux is
+func (m *MultiMux) Closed() <-chan struct{} {
+	return m.closed
+}
+
+// Drain stops opening new streams on the physical connections currently in the bundle,
+// each of them is closed as soon as its last stream is, connections added later are used as usual
+func (m *MultiMux) Drain() {
+	m.drain(func(*physicalConn) bool { return true })
+}
+
+// DrainConn drains a single physical connection, identified by its remote address as listed by Stats,
+// the other connections of the bundle keep taking new streams
+func (m *MultiMux) DrainConn(remoteAddr string) error {
+	if m.drain(func(pc *physicalConn) bool { return pc.RemoteAddr().String() == remoteAddr }) == 0 {
+		return errors.New("multimux: no connection to drain from: " + remoteAddr)
+	}
+	return nil
+}
+
+// drain marks the matching connections as draining & closes the idle ones, it returns how many it marked
+// the connections are marked & checked under the lock streams are counted under, so Open never picks a connection
+// which is about to be closed
+func (m *MultiMux) drain(match func(*physicalConn) bool) int {
+	marked := 0
+	idle := []*physicalConn{}
+	m.mu.Lock()
+	for _, pc := range m.connections {
+		if !match(pc) {
+			continue
+		}
+		marked++
+		atomic.StoreInt32(&pc.draining, 1)
+		if atomic.LoadInt64(&pc.activeStreams) == 0 {
+			idle = append(idle, pc)
+		}
+	}
+	m.mu.Unlock()
+	for _, pc := range idle {
+		pc.Close()
+	}
+	return marked
+}
+
+// release uncounts a stream, the last stream of a draining connection takes the connection with it
+func (pc *physicalConn) release() {
+	if atomic.AddInt64(&pc.activeStreams, -1) == 0 && pc.isDraining() {
+		pc.Close()
+	}
+}
+
+func (pc *physicalConn) isDraining() bool {
+	return atomic.LoadInt32(&pc.draining) == 1
+}
+
+// Open opens a new stream on the physical connection chosen by the scheduling strategy,
+// a connection which fails to open the stream is skipped, ErrNoHealthySession is returned when none is left
 func (m *MultiMux) Open() (net.Conn, error) {
-	connCount := len(m.connections)
-	pick := rand.Intn(connCount)
+	var failed []*physicalConn
+	for {
+		m.mu.Lock()
+		select {
+		case <-m.closed:
+			m.mu.Unlock()
+			return nil, ErrMuxClosed
+		default:
+		}
+		candidates := make([]*physicalConn, 0, len(m.connections))
+		for _, pc := range m.connections {
+			if !pc.isDraining() && !containsConn(failed, pc) {
+				candidates = append(candidates, pc)
+			}
+		}
+		if len(candidates) == 0 {
+			m.mu.Unlock()
+			return nil, ErrNoHealthySession
+		}
+		pc := m.schedule(candidates, m.rr)
+		m.rr++
+		atomic.AddInt64(&pc.activeStreams, 1) // counted before a Drain can see the connection idle
+		m.mu.Unlock()
 
-	//m.mu.RLock()
-	sess := m.connections[pick]
-	//m.mu.RUnlock()
+		stream, err := pc.Open()
+		if err == nil {
+			return newTrackedStream(stream, pc), nil
+		}
+		pc.release()
+		logger.Warn("MultiMux.Open: physical connection failed to open a stream: ", err)
+		failed = append(failed, pc)
+	}
+}
 
-	return sess.Open()
+func containsConn(conns []*physicalConn, pc *physicalConn) bool {
+	for _, c := range conns {
+		if c == pc {
+			return true
+		}
+	}
+	return false
 }
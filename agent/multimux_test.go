@@ -0,0 +1,294 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newMuxPair creates a client & server multi-mux connected by a single in-memory physical connection
+func newMuxPair(heartbeatSecs int) (*MultiMux, *MultiMux) {
+	c1, c2 := net.Pipe()
+	client := NewMultiMux(true)
+	client.SetHeartbeat(heartbeatSecs, heartbeatSecs)
+	server := NewMultiMux(false)
+	server.AddConnection(c2)
+	client.AddConnection(c1)
+	return client, server
+}
+
+func TestHeartbeatRecordsRTT(t *testing.T) {
+	client, server := newMuxPair(1)
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		task, err := ReadTunnelTask(conn)
+		if err != nil || task.Header.Type != TaskTypePing {
+			return
+		}
+		answerPings(task)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := client.Stats()
+		if len(stats) == 1 && stats[0].RTT > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no ping round trip was recorded: %+v", stats)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestHeartbeatTimeoutClosesConnection(t *testing.T) {
+	client, server := newMuxPair(1)
+
+	// accept the ping stream but never answer it
+	go server.Accept()
+
+	select {
+	case <-client.ConnectionLost():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection was not torn down after missing pongs")
+	}
+	if client.Len() != 0 {
+		t.Fatalf("dead connection is still in the bundle")
+	}
+}
+
+func TestSchedulingStrategies(t *testing.T) {
+	a := &physicalConn{activeStreams: 3, bytesInFlight: 10, rtt: 30 * time.Millisecond}
+	b := &physicalConn{activeStreams: 1, bytesInFlight: 500, rtt: 0} // not measured yet
+	c := &physicalConn{activeStreams: 2, bytesInFlight: 0, rtt: 50 * time.Millisecond}
+	conns := []*physicalConn{a, b, c}
+
+	if pc := scheduleLeastStreams(conns, 0); pc != b {
+		t.Errorf("least-streams should pick the connection with one stream")
+	}
+	if pc := scheduleLowestRtt(conns, 0); pc != a {
+		t.Errorf("lowest-rtt should pick the fastest measured connection")
+	}
+	if pc := scheduleLeastBytes(conns, 0); pc != c {
+		t.Errorf("least-bytes should pick the idle connection")
+	}
+	for i, expected := range []*physicalConn{a, b, c, a} {
+		if pc := scheduleRoundRobin(conns, i); pc != expected {
+			t.Errorf("round-robin out of turn at %d", i)
+		}
+	}
+
+	// ties are spread by the round robin position
+	tied := []*physicalConn{{}, {}, {}}
+	if scheduleLeastStreams(tied, 1) != tied[1] || scheduleLeastStreams(tied, 2) != tied[2] {
+		t.Errorf("ties should rotate")
+	}
+
+	if err := NewMultiMux(true).SetScheduling("fastest-please"); err == nil {
+		t.Errorf("an unknown strategy should be refused")
+	}
+}
+
+func TestOpenSpreadsStreams(t *testing.T) {
+	client := NewMultiMux(true)
+	server := NewMultiMux(false)
+	for i := 0; i < 3; i++ {
+		c1, c2 := net.Pipe()
+		server.AddConnection(c2)
+		client.AddConnection(c1)
+	}
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	streams := []net.Conn{}
+	for i := 0; i < 6; i++ {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatalf("failed opening stream: %s", err)
+		}
+		streams = append(streams, stream)
+	}
+	for _, s := range client.Stats() {
+		if s.ActiveStreams != 2 {
+			t.Fatalf("streams were not spread evenly: %+v", client.Stats())
+		}
+	}
+
+	for _, stream := range streams {
+		stream.Close()
+		stream.Close() // counted once
+	}
+	for _, s := range client.Stats() {
+		if s.ActiveStreams != 0 {
+			t.Fatalf("closed streams are still counted: %+v", client.Stats())
+		}
+	}
+
+	if _, err := NewMultiMux(true).Open(); err != ErrNoHealthySession {
+		t.Fatalf("an empty bundle should return ErrNoHealthySession, got: %v", err)
+	}
+}
+
+// waitForLen waits for the bundle to shrink to the given number of physical connections
+func waitForLen(t *testing.T, m *MultiMux, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connections in the bundle, has: %d", n, m.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMuxDrainAndClose(t *testing.T) {
+	client := NewMultiMux(true)
+	server := NewMultiMux(false)
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		server.AddConnection(c2)
+		client.AddConnection(c1)
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				accepted <- err
+				return
+			}
+		}
+	}()
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatalf("failed opening stream: %s", err)
+	}
+
+	// the idle connection goes right away, the busy one once its stream is done
+	client.Drain()
+	if _, err := client.Open(); err != ErrNoHealthySession {
+		t.Fatalf("a draining bundle should not open streams, got: %v", err)
+	}
+	waitForLen(t, client, 1)
+	stream.Close()
+	waitForLen(t, client, 0)
+
+	// closing unblocks Accept & refuses anything new
+	server.Close()
+	select {
+	case err := <-accepted:
+		if err != ErrMuxClosed {
+			t.Fatalf("expected ErrMuxClosed from Accept, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Accept is still blocked after Close")
+	}
+	select {
+	case <-server.Closed():
+	default:
+		t.Fatalf("Closed() was not signaled")
+	}
+	c1, _ := net.Pipe()
+	server.AddConnection(c1)
+	if server.Len() != 0 {
+		t.Fatalf("a closed bundle should not take connections")
+	}
+	if _, err := server.Open(); err != ErrMuxClosed {
+		t.Fatalf("expected ErrMuxClosed from Open, got: %v", err)
+	}
+}
+
+// addrConn gives a pipe end a distinct remote address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestMuxDrainConn(t *testing.T) {
+	client := NewMultiMux(true)
+	server := NewMultiMux(false)
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		server.AddConnection(c2)
+		client.AddConnection(&addrConn{Conn: c1, remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000 + i}})
+	}
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := client.DrainConn("127.0.0.1:9999"); err == nil {
+		t.Fatalf("draining an unknown connection should fail")
+	}
+	if err := client.DrainConn("127.0.0.1:10000"); err != nil {
+		t.Fatalf("failed draining a connection: %s", err)
+	}
+	waitForLen(t, client, 1)
+
+	// the other connection keeps taking streams
+	for i := 0; i < 3; i++ {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatalf("the connection which isn't draining should open streams: %s", err)
+		}
+		defer stream.Close()
+	}
+	stats := client.Stats()
+	if len(stats) != 1 || stats[0].RemoteAddr != "127.0.0.1:10001" || stats[0].ActiveStreams != 3 {
+		t.Fatalf("the streams should all be on the remaining connection, got: %+v", stats)
+	}
+}
+
+func TestMuxDrainWithHeartbeat(t *testing.T) {
+	client := NewMultiMux(true)
+	client.SetHeartbeat(1, 5)
+	server := NewMultiMux(false)
+	c1, c2 := net.Pipe()
+	server.AddConnection(c2)
+	client.AddConnection(c1)
+
+	rtr := NewRouter()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			task, err := ReadTunnelTask(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go rtr.route(task)
+		}
+	}()
+
+	// once a ping was answered, the ping stream is the only one on the connection
+	deadline := time.Now().Add(5 * time.Second)
+	for stats := client.Stats(); len(stats) != 1 || stats[0].LastPong.IsZero(); stats = client.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no pong was received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the side answering pings drains its connection as an idle one
+	server.Drain()
+	waitForLen(t, server, 0)
+	waitForLen(t, client, 0)
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoHealthySession is returned by Open when no physical connection in the bundle can carry a new stream
+var ErrNoHealthySession = errors.New("multimux: no healthy session in the bundle")
+
+// scheduling strategies, they decide which physical connection in the bundle carries a new stream
+const (
+	ScheduleRoundRobin   = "round-robin"   // each connection in turn
+	ScheduleLeastStreams = "least-streams" // the connection with the fewest open streams (default)
+	ScheduleLowestRtt    = "lowest-rtt"    // the connection with the fastest heartbeat round trip
+	ScheduleLeastBytes   = "least-bytes"   // the connection with the fewest bytes waiting to be written
+)
+
+// scheduler picks a connection out of the candidates (never empty), rr is a counter that rotates between calls
+type scheduler func(candidates []*physicalConn, rr int) *physicalConn
+
+var schedulers = map[string]scheduler{
+	ScheduleRoundRobin:   scheduleRoundRobin,
+	ScheduleLeastStreams: scheduleLeastStreams,
+	ScheduleLowestRtt:    scheduleLowestRtt,
+	ScheduleLeastBytes:   scheduleLeastBytes,
+}
+
+func scheduleRoundRobin(candidates []*physicalConn, rr int) *physicalConn {
+	return candidates[rr%len(candidates)]
+}
+
+// pickMin returns the candidate with the lowest key, starting at the round robin position so ties are spread out
+func pickMin(candidates []*physicalConn, rr int, less func(a, b *physicalConn) bool) *physicalConn {
+	best := candidates[rr%len(candidates)]
+	for i := 1; i < len(candidates); i++ {
+		c := candidates[(rr+i)%len(candidates)]
+		if less(c, best) {
+			best = c
+		}
+	}
+	return best
+}
+
+func fewerStreams(a, b *physicalConn) bool {
+	return atomic.LoadInt64(&a.activeStreams) < atomic.LoadInt64(&b.activeStreams)
+}
+
+func scheduleLeastStreams(candidates []*physicalConn, rr int) *physicalConn {
+	return pickMin(candidates, rr, fewerStreams)
+}
+
+// scheduleLowestRtt prefers measured connections, until the first pong arrives a connection's rtt is unknown
+func scheduleLowestRtt(candidates []*physicalConn, rr int) *physicalConn {
+	return pickMin(candidates, rr, func(a, b *physicalConn) bool {
+		if (a.rtt == 0) != (b.rtt == 0) {
+			return a.rtt != 0
+		}
+		if a.rtt != b.rtt {
+			return a.rtt < b.rtt
+		}
+		return fewerStreams(a, b)
+	})
+}
+
+func scheduleLeastBytes(candidates []*physicalConn, rr int) *physicalConn {
+	return pickMin(candidates, rr, func(a, b *physicalConn) bool {
+		aBytes, bBytes := atomic.LoadInt64(&a.bytesInFlight), atomic.LoadInt64(&b.bytesInFlight)
+		if aBytes != bBytes {
+			return aBytes < bBytes
+		}
+		return fewerStreams(a, b)
+	})
+}
+
+// trackedStream keeps its physical connection's load counters up to date
+type trackedStream struct {
+	net.Conn
+	pc        *physicalConn
+	closeOnce sync.Once
+}
+
+// newTrackedStream wraps a stream already counted in its connection's activeStreams
+func newTrackedStream(conn net.Conn, pc *physicalConn) *trackedStream {
+	return &trackedStream{Conn: conn, pc: pc}
+}
+
+// Write counts the bytes muxado hasn't taken yet, a write blocks while the stream's send window is full
+func (s *trackedStream) Write(b []byte) (int, error) {
+	atomic.AddInt64(&s.pc.bytesInFlight, int64(len(b)))
+	defer atomic.AddInt64(&s.pc.bytesInFlight, -int64(len(b)))
+	return s.Conn.Write(b)
+}
+
+func (s *trackedStream) Close() error {
+	err := s.Conn.Close()
+	s.untrack()
+	return err
+}
+
+// untrack stops counting the stream on its connection, for streams which live as long as the connection (pings)
+func (s *trackedStream) untrack() {
+	s.closeOnce.Do(s.pc.release)
+}
+
+// CloseWrite half closes the stream, so proxy() can signal the end of one direction
+func (s *trackedStream) CloseWrite() error {
+	if cw, ok := s.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"teleporter/logger"
+)
+
+// nodeCertValidity matches what mkcerts.sh used to generate
+const nodeCertValidity = 10 * 365 * 24 * time.Hour
+
+// GenerateNodeCert creates a new ECDSA key pair and a self signed certificate for the node, replacing any existing files,
+// it returns the certificate's fingerprint, which peers pin in their tether configuration
+func GenerateNodeCert(certFile, keyFile, commonName string) (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"teleporter"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(nodeCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if commonName != "" {
+		tmpl.DNSNames = []string{commonName}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	// key first, so a crash in between never leaves a certificate without its key
+	err = writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", err
+	}
+	err = writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return "", err
+	}
+	logger.Info("GenerateNodeCert: generated a new node certificate at: ", certFile)
+	return CertFingerprint(der), nil
+}
+
+// EnsureNodeCert generates the node's certificate if it does not exist yet, and returns its fingerprint
+func EnsureNodeCert(certFile, keyFile, commonName string) (string, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return GenerateNodeCert(certFile, keyFile, commonName)
+	}
+	if os.IsNotExist(certErr) || os.IsNotExist(keyErr) {
+		return "", errors.New("EnsureNodeCert: only one of " + certFile + ", " + keyFile + " exists, refusing to overwrite it")
+	}
+	return LoadCertFingerprint(certFile)
+}
+
+// LoadCertFingerprint returns the fingerprint of the first certificate in a PEM file
+func LoadCertFingerprint(certFile string) (string, error) {
+	certPem, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(certPem)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.New("LoadCertFingerprint: no certificate found in: " + certFile)
+	}
+	return CertFingerprint(block.Bytes), nil
+}
+
+// writeFileAtomic replaces the file in one go, so a running node never reads a half written certificate
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeCertBootstrap(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+
+	fp, err := EnsureNodeCert(certFile, keyFile, "testNode")
+	if err != nil {
+		t.Fatalf("failed generating node certificate: %s", err)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatalf("generated key pair can't be loaded: %s", err)
+	}
+	if info, _ := os.Stat(keyFile); info.Mode().Perm() != 0600 {
+		t.Fatalf("private key should only be readable by its owner, mode: %v", info.Mode())
+	}
+
+	// a second run keeps the existing identity
+	fp2, err := EnsureNodeCert(certFile, keyFile, "testNode")
+	if err != nil || fp2 != fp {
+		t.Fatalf("existing certificate was not kept: %s != %s, %v", fp2, fp, err)
+	}
+
+	// rotation replaces it
+	fp3, err := GenerateNodeCert(certFile, keyFile, "testNode")
+	if err != nil || fp3 == fp {
+		t.Fatalf("rotation did not create a new certificate: %v", err)
+	}
+	if loaded, _ := LoadCertFingerprint(certFile); loaded != fp3 {
+		t.Fatalf("fingerprint of the rotated certificate doesn't match: %s != %s", loaded, fp3)
+	}
+
+	os.Remove(keyFile)
+	if _, err := EnsureNodeCert(certFile, keyFile, "testNode"); err == nil {
+		t.Fatalf("a certificate without its key should not be silently replaced")
+	}
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"teleporter/logger"
+)
+
+const (
+	// quicAlpn identifies teleporter relays in the tls handshake of a quic connection
+	quicAlpn = "teleporter"
+
+	quicMaxIdleTimeout = 60 * time.Second
+)
+
+func newQuicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  quicMaxIdleTimeout,
+		KeepAlivePeriod: quicMaxIdleTimeout / 3,
+	}
+}
+
+// quicConn presents a quic connection as a single net.Conn, carrying one bidirectional stream
+// the muxado session of the tether runs on top of it just like it does on a tls connection
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicConn) Close() error {
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// quicListener adapts a quic listener into a net.Listener which returns a quicConn for every connecting node
+type quicListener struct {
+	*quic.Listener
+}
+
+// Accept waits for the next quic connection and opens its stream,
+// the server opens it since it is also the side which speaks first in the net-config handshake
+func (l *quicListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		stream, err := conn.OpenStreamSync(ctx)
+		cancel()
+		if err != nil {
+			logger.Error("quicListener.Accept: failed opening stream to: ", conn.RemoteAddr(), err)
+			conn.CloseWithError(0, "")
+			continue
+		}
+		return &quicConn{Stream: stream, conn: conn}, nil
+	}
+}
+
+// createQuicControlListener creates a listener of type: relayUdp (with encryption = quic's tls 1.3)
+func createQuicControlListener(listenAddress string, serverConf *ListenerConfig) (net.Listener, error) {
+	tlsconfig, err := serverTlsConfig(serverConf)
+	if err != nil {
+		return nil, err
+	}
+	tlsconfig.NextProtos = []string{quicAlpn}
+
+	l, err := quic.ListenAddr(listenAddress, tlsconfig, newQuicConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("createQuicControlListener: Started server at " + listenAddress)
+	return &quicListener{Listener: l}, nil
+}
+
+// dialQuic opens a quic connection to the server and waits for the stream the server opens on it
+func dialQuic(serverAddress string, tlsconfig *tls.Config) (net.Conn, error) {
+	quicTlsConfig := tlsconfig.Clone()
+	quicTlsConfig.NextProtos = []string{quicAlpn}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, serverAddress, quicTlsConfig, newQuicConfig())
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: conn}, nil
+}
@@ -0,0 +1,7 @@
+package agent
+
+import "testing"
+
+func TestQuicTether(t *testing.T) {
+	testTetherTransport(t, 10321, ListenerConfig{Type: "relayUdp"}, TetherConfig{ConnectionType: "quic"})
+}
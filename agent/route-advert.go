@@ -0,0 +1,300 @@
+package agent
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"teleporter/logger"
+)
+
+// nodes advertise what they can reach to all of their peers, a simple path-vector flavour of distance-vector routing:
+// every advert is the sender's complete table, it holds the prefixes the sender exports (path: [sender]) and the
+// routes it learned from others (path: [sender, <the path it learned>]), so a route missing from an advert is withdrawn.
+// routes whose path already contains the receiving node are dropped (loop prevention), as are paths longer than maxRouteHops.
+const (
+	routeAdvertInterval = 30 * time.Second
+	routeAdvertExpiry   = 3 * routeAdvertInterval
+	maxRouteHops        = 16
+	maxAdvertRoutes     = 4096
+)
+
+// advertRoute is a destination reachable through the advertising node
+type advertRoute struct {
+	Prefix string   `json:"prefix,omitempty"` // a host glob / cidr (+ ports) served by the last node of the path, empty for the node itself
+	Path   []string `json:"path"`             // the nodes from the advertising node to the owner of the prefix
+}
+
+type routeAdvert struct {
+	Routes []advertRoute `json:"routes"`
+}
+
+// peerRoutes is the latest advert received from a peer
+type peerRoutes struct {
+	routes  []advertRoute
+	expires time.Time
+}
+
+func pathContains(path []string, id string) bool {
+	for _, p := range path {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// triggerRouteAdvert asks for our routes to be advertised to all peers soon, starting the advert loop on first use
+func (rtr *Router) triggerRouteAdvert() {
+	rtr.advertOnce.Do(func() {
+		rtr.advertNow = make(chan struct{}, 1)
+		go rtr.runRouteAdverts()
+	})
+	select {
+	case rtr.advertNow <- struct{}{}:
+	default:
+	}
+}
+
+// runRouteAdverts sends our routes to every connected peer, periodically and whenever they change
+func (rtr *Router) runRouteAdverts() {
+	ticker := time.NewTicker(routeAdvertInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rtr.expireLearnedRoutes()
+		case <-rtr.advertNow:
+		}
+
+		rtr.mu.RLock()
+		peers := make(map[string]*Tether, len(rtr.tethers))
+		for id, teth := range rtr.tethers {
+			// peers which don't speak the advert protocol would just drop the stream
+			if teth.Features.Has(capRouteAdverts) {
+				peers[id] = teth
+			}
+		}
+		rtr.mu.RUnlock()
+
+		for id, teth := range peers {
+			if teth.Len() == 0 {
+				continue
+			}
+			go rtr.sendRouteAdvert(teth, rtr.buildRouteAdvert(id))
+		}
+	}
+}
+
+// buildRouteAdvert builds our complete table for the given peer, leaving out routes that pass through the peer anyway
+func (rtr *Router) buildRouteAdvert(peerId string) *routeAdvert {
+	self := rtr.NetworkConfig.ClientId
+	advert := &routeAdvert{Routes: []advertRoute{{Path: []string{self}}}}
+	exports, ok := rtr.NetworkConfig.PeerExports[peerId]
+	if !ok {
+		exports = rtr.NetworkConfig.NetworkExports
+	}
+	for _, prefix := range exports {
+		advert.Routes = append(advert.Routes, advertRoute{Prefix: prefix, Path: []string{self}})
+	}
+
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	// peers in a fixed order, so an unchanged table makes an identical advert
+	vias := make([]string, 0, len(rtr.learned))
+	for via := range rtr.learned {
+		vias = append(vias, via)
+	}
+	sort.Strings(vias)
+
+	now := time.Now()
+	for _, via := range vias {
+		learned := rtr.learned[via]
+		if now.After(learned.expires) {
+			continue
+		}
+		for _, r := range learned.routes {
+			if len(r.Path) >= maxRouteHops || pathContains(r.Path, peerId) || pathContains(r.Path, self) {
+				continue
+			}
+			path := append([]string{self}, r.Path...)
+			advert.Routes = append(advert.Routes, advertRoute{Prefix: r.Prefix, Path: path})
+		}
+	}
+	return advert
+}
+
+func (rtr *Router) sendRouteAdvert(teth *Tether, advert *routeAdvert) {
+	conn, err := teth.Open()
+	if err != nil {
+		logger.Debug("sendRouteAdvert: failed opening stream: ", err)
+		return
+	}
+	defer conn.Close()
+
+	err = writeTaskInfo(conn, &TaskInfo{Type: TaskTypeRouteAdvert})
+	if err != nil {
+		return
+	}
+	err = writeJsonMessage(conn, advert)
+	if err != nil {
+		logger.Debug("sendRouteAdvert: failed sending advert: ", err)
+	}
+}
+
+// receiveRouteAdvert reads a peer's advert and replaces all routes previously learned from it
+func (rtr *Router) receiveRouteAdvert(task *TunnelTask) error {
+	peerId := task.Peer
+	if peerId == "" {
+		return errors.New("receiveRouteAdvert: route adverts are only accepted from peers")
+	}
+	advert := routeAdvert{}
+	err := readJsonMessage(task, &advert)
+	if err != nil {
+		return err
+	}
+	if len(advert.Routes) > maxAdvertRoutes {
+		return errors.New("receiveRouteAdvert: too many routes in advert from: " + peerId)
+	}
+
+	self := rtr.NetworkConfig.ClientId
+	routes := []advertRoute{}
+	for _, r := range advert.Routes {
+		// the path has to start at the peer, which is the only part we can vouch for
+		if len(r.Path) == 0 || r.Path[0] != peerId {
+			continue
+		}
+		if pathContains(r.Path, self) {
+			logger.Debug("receiveRouteAdvert: dropping looped route from: ", peerId, r.Path)
+			continue
+		}
+		if len(r.Path) > maxRouteHops {
+			continue
+		}
+		if r.Prefix != "" {
+			if _, err := compileRouteConfig(mappingToRoute(r.Prefix, "local")); err != nil {
+				logger.Warn("receiveRouteAdvert: bad prefix from: ", peerId, err)
+				continue
+			}
+		}
+		routes = append(routes, r)
+	}
+
+	rtr.mu.Lock()
+	if rtr.learned == nil {
+		rtr.learned = make(map[string]*peerRoutes)
+	}
+	old := rtr.learned[peerId]
+	changed := old == nil || !sameAdvertRoutes(old.routes, routes)
+	rtr.learned[peerId] = &peerRoutes{routes: routes, expires: time.Now().Add(routeAdvertExpiry)}
+	if changed {
+		rtr.routesVersion++
+	}
+	rtr.mu.Unlock()
+
+	if changed {
+		logger.Debug("receiveRouteAdvert: routes from ", peerId, " changed, now has: ", len(routes))
+		rtr.triggerRouteAdvert()
+	}
+	return nil
+}
+
+func sameAdvertRoutes(a, b []advertRoute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Prefix != b[i].Prefix || len(a[i].Path) != len(b[i].Path) {
+			return false
+		}
+		for j := range a[i].Path {
+			if a[i].Path[j] != b[i].Path[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// expireLearnedRoutes drops the routes of peers we haven't heard from for a while
+func (rtr *Router) expireLearnedRoutes() {
+	rtr.mu.Lock()
+	defer rtr.mu.Unlock()
+	now := time.Now()
+	for id, learned := range rtr.learned {
+		if now.After(learned.expires) {
+			logger.Info("expireLearnedRoutes: routes learned from ", id, " expired")
+			delete(rtr.learned, id)
+			rtr.routesVersion++
+		}
+	}
+}
+
+// learnedNextHops maps every learned prefix to the peers it can be reached through, nearest first
+// must be called with the lock held
+func (rtr *Router) learnedNextHops() map[string][]string {
+	type candidate struct {
+		via  string
+		hops int
+	}
+	candidates := make(map[string][]candidate)
+	now := time.Now()
+	for via, learned := range rtr.learned {
+		if now.After(learned.expires) {
+			continue
+		}
+		for _, r := range learned.routes {
+			if r.Prefix != "" {
+				candidates[r.Prefix] = append(candidates[r.Prefix], candidate{via, len(r.Path)})
+			}
+		}
+	}
+
+	nextHops := make(map[string][]string, len(candidates))
+	for prefix, cands := range candidates {
+		sort.Slice(cands, func(i, j int) bool {
+			if cands[i].hops != cands[j].hops {
+				return cands[i].hops < cands[j].hops
+			}
+			return cands[i].via < cands[j].via
+		})
+		for _, c := range cands {
+			if !pathContains(nextHops[prefix], c.via) {
+				nextHops[prefix] = append(nextHops[prefix], c.via)
+			}
+		}
+	}
+	return nextHops
+}
+
+// nodeNextHops returns the peers through which a node that isn't directly connected can be reached, nearest first
+func (rtr *Router) nodeNextHops(nodeId string) []string {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	best := make(map[string]int)
+	now := time.Now()
+	for via, learned := range rtr.learned {
+		if now.After(learned.expires) {
+			continue
+		}
+		for _, r := range learned.routes {
+			for i, id := range r.Path {
+				if id == nodeId && (best[via] == 0 || i+1 < best[via]) {
+					best[via] = i + 1
+				}
+			}
+		}
+	}
+
+	vias := make([]string, 0, len(best))
+	for via := range best {
+		vias = append(vias, via)
+	}
+	sort.Slice(vias, func(i, j int) bool {
+		if best[vias[i]] != best[vias[j]] {
+			return best[vias[i]] < best[vias[j]]
+		}
+		return vias[i] < vias[j]
+	})
+	return vias
+}
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// deliverAdvert feeds an advert into the router as if it arrived from the given peer
+func deliverAdvert(t *testing.T, rtr *Router, peerId string, advert *routeAdvert) {
+	local, remote := net.Pipe()
+	go func() {
+		writeJsonMessage(remote, advert)
+		remote.Close()
+	}()
+	task := NewTunnelTask(local, &TaskInfo{Type: TaskTypeRouteAdvert})
+	task.Peer = peerId
+	if err := rtr.receiveRouteAdvert(task); err != nil {
+		t.Fatalf("advert was refused: %s", err)
+	}
+}
+
+func TestRouteAdvertLoopsAndHopLimit(t *testing.T) {
+	rtr := NewRouter()
+	rtr.NetworkConfig.ClientId = "self"
+
+	tooLong := []string{"peer"}
+	for i := 0; i < maxRouteHops; i++ {
+		tooLong = append(tooLong, "n"+strconv.Itoa(i))
+	}
+	deliverAdvert(t, rtr, "peer", &routeAdvert{Routes: []advertRoute{
+		{Path: []string{"peer"}},
+		{Prefix: "*.peer.net", Path: []string{"peer"}},
+		{Prefix: "*.far.net", Path: []string{"peer", "far"}},
+		{Prefix: "*.looped.net", Path: []string{"peer", "self", "other"}},
+		{Prefix: "*.spoofed.net", Path: []string{"someoneElse"}},
+		{Prefix: "*.toofar.net", Path: tooLong},
+		{Prefix: "bad:port", Path: []string{"peer"}},
+	}})
+
+	nextHops := rtr.learnedNextHops()
+	if len(nextHops) != 2 || nextHops["*.peer.net"][0] != "peer" || nextHops["*.far.net"][0] != "peer" {
+		t.Fatalf("unexpected learned routes: %v", nextHops)
+	}
+	if vias := rtr.nodeNextHops("far"); len(vias) != 1 || vias[0] != "peer" {
+		t.Fatalf("node far should be reachable through peer, got: %v", vias)
+	}
+
+	// we never advertise a route back to a node on its path, nor routes through ourselves
+	for _, r := range rtr.buildRouteAdvert("far").Routes {
+		if pathContains(r.Path, "far") {
+			t.Fatalf("route advertised back to a node on its path: %v", r)
+		}
+	}
+	if advert := rtr.buildRouteAdvert("other"); len(advert.Routes) != 4 || advert.Routes[1].Path[0] != "self" {
+		t.Fatalf("unexpected advert: %v", advert.Routes)
+	}
+
+	// an advert replaces everything learned from the peer
+	deliverAdvert(t, rtr, "peer", &routeAdvert{Routes: []advertRoute{{Path: []string{"peer"}}}})
+	if nextHops := rtr.learnedNextHops(); len(nextHops) != 0 {
+		t.Fatalf("withdrawn routes were kept: %v", nextHops)
+	}
+}
+
+func TestLearnedRoutesAfterStaticRules(t *testing.T) {
+	rtr := NewRouter()
+	rtr.NetworkConfig.ClientId = "self"
+	rtr.NetworkConfig.Mapping["*.corp.com"] = "nodeB"
+	deliverAdvert(t, rtr, "peer", &routeAdvert{Routes: []advertRoute{
+		{Prefix: "db.corp.com", Path: []string{"peer"}},
+		{Prefix: "*.peer.net", Path: []string{"peer"}},
+	}})
+
+	// a more specific advert doesn't take traffic our own rules send elsewhere
+	if rule := rtr.getRouteTable().lookup("db.corp.com", "5432"); rule == nil || rule.hops[0].tetherId != "nodeB" {
+		t.Errorf("a static rule should win over a learned route, got: %+v", rule)
+	}
+	if rule := rtr.getRouteTable().lookup("www.peer.net", "80"); rule == nil || rule.hops[0].tetherId != "peer" {
+		t.Errorf("a learned route should be used where no static rule matches, got: %+v", rule)
+	}
+}
+
+func TestSameExportOnTwoExits(t *testing.T) {
+	// two exits of the same network learn it from each other, each serves it itself instead of relaying to the other
+	for _, ids := range [][2]string{{"exitA", "exitB"}, {"exitB", "exitA"}} {
+		rtr := NewRouter()
+		rtr.NetworkConfig.ClientId = ids[0]
+		rtr.NetworkConfig.NetworkExports = []string{"10.0.0.0/8"}
+		deliverAdvert(t, rtr, ids[1], &routeAdvert{Routes: []advertRoute{
+			{Prefix: "10.0.0.0/8", Path: []string{ids[1]}},
+			{Prefix: "*.peer.net", Path: []string{ids[1]}},
+		}})
+
+		for _, path := range [][]string{{"client"}, nil} {
+			_, action, err := rtr.getTargetTether(&TaskInfo{TargetAddress: "10.1.2.3", TargetPort: "80", Path: path})
+			if err != nil || action != actionLocal {
+				t.Errorf("%s should serve its own export (path %v), got: %v %v", ids[0], path, action, err)
+			}
+		}
+		if _, action, _ := rtr.getTargetTether(&TaskInfo{TargetAddress: "www.peer.net", TargetPort: "80", Path: []string{"client"}}); action == actionLocal {
+			t.Errorf("%s should not serve a learned route it doesn't export", ids[0])
+		}
+	}
+}
+
+func TestRoutePropagation(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	echoPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	// nodeA -> hub <- nodeC, only nodeC knows anything about the echo server
+	hub := NewRouter()
+	hub.NetworkConfig.ClientId = "hub"
+	err = hub.Serve(ListenerConfig{Port: 10361, Type: "relayTcp"})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	nodeC := NewRouter()
+	nodeC.NetworkConfig.ClientId = "nodeC"
+	nodeC.NetworkConfig.NetworkExports = []string{"127.0.0.1:" + echoPort}
+
+	nodeA := NewRouter()
+	nodeA.NetworkConfig.ClientId = "nodeA"
+	nodeA.NetworkConfig.Mapping["*.far"] = "nodeC"
+	err = nodeA.Serve(ListenerConfig{Port: 10362, Type: "socks5", LocalOnly: true})
+	if err != nil {
+		t.Fatalf("failed to start socks5 listener: %s", err)
+	}
+
+	for _, node := range []*Router{nodeA, nodeC} {
+		err = node.Connect(&TetherConfig{TargetPort: 10361, TargetHost: "localhost", ConnectionType: "tls", Insecure: true}, 2)
+		if err != nil {
+			t.Fatalf("failed to connect tether: %s", err)
+		}
+	}
+
+	echoTask := &TaskInfo{TargetAddress: "127.0.0.1", TargetPort: echoPort}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		teth, action, _ := nodeA.getTargetTether(echoTask)
+		if teth != nil && action == actionTether && nodeA.tetherId(teth) == "hub" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("route to nodeC's export did not propagate to nodeA")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a static route naming a node which isn't directly connected goes through the peer that advertised it
+	farTask := &TaskInfo{TargetAddress: "x.far", TargetPort: "80"}
+	teth, _, err := nodeA.getTargetTether(farTask)
+	if err != nil || nodeA.tetherId(teth) != "hub" || farTask.TargetNode != "nodeC" {
+		t.Fatalf("expected a route to nodeC through hub, got: %v %v", farTask.TargetNode, err)
+	}
+	teth, _, err = hub.getTargetTether(farTask)
+	if err != nil || hub.tetherId(teth) != "nodeC" {
+		t.Fatalf("hub should pass tasks for nodeC on to it: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:10362")
+	if err != nil {
+		t.Fatalf("failed to connect to socks5 listener: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{5, 1, 0})
+	port, _ := strconv.Atoi(echoPort)
+	conn.Write(append([]byte{5, ConnectCommand, 0}, socks5AddrBytes("127.0.0.1", port)...))
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != socks5Success {
+		t.Fatalf("socks5 connect through two hops failed: %v %v", reply, err)
+	}
+	conn.Write([]byte("two hops"))
+	buf := make([]byte, len("two hops"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "two hops" {
+		t.Fatalf("bad echo through two hops: %q %v", buf, err)
+	}
+}
@@ -0,0 +1,479 @@
+package agent
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"teleporter/logger"
+)
+
+// ruleKind orders the rules converted from the legacy network mapping, the most specific kind of rule that matches a target wins
+type ruleKind int
+
+const (
+	ruleExact    ruleKind = iota // www.google.com, 10.1.2.3
+	ruleSuffix                   // *.google.com, *google.com
+	ruleCidr                     // 10.0.0.0/8
+	ruleGlob                     // *google*, www.*.com, regex
+	ruleCatchAll                 // *
+)
+
+// routeAction is what a node does with a task that matched a rule
+type routeAction int
+
+const (
+	actionLocal          routeAction = iota // execute in the local network
+	actionTether                            // relay through a tether
+	actionReject                            // refuse the connection
+	actionDirectViaProxy                    // connect to the target through the node's http proxy
+)
+
+// routeHop is one of the next hops of a rule, the first one available is taken
+type routeHop struct {
+	action   routeAction
+	tetherId string
+	weight   int // for weighted rules
+}
+
+// routeRule is a single compiled routing rule: a matcher (host / regex / cidr, and ports) and a list of next hops
+type routeRule struct {
+	key         string // the rule as written in the configuration
+	kind        ruleKind
+	host        string // exact host, or the suffix of a suffix rule
+	cidr        *net.IPNet
+	glob        *regexp.Regexp
+	specificity int // suffix length, cidr prefix length or glob literal length
+	portMin     int // 0 means any port
+	portMax     int
+	hops        []routeHop
+	weighted    bool // flows are spread over the tether hops
+	sticky      bool // the spreading is decided by the client's address instead of at random
+	learned     bool // the rule comes from a peer's advert
+}
+
+// routeTable holds the routing rules in the order they are evaluated, it is compiled once per configuration
+type routeTable struct {
+	conf    *ClientConfig // the configuration & learned routes version this table was compiled from
+	version int
+	rules   []*routeRule
+
+	exports     []*routeRule            // what we serve to peers, nil when no export policy is configured
+	peerExports map[string][]*routeRule // per peer replacements of exports
+}
+
+// splitRulePort separates the optional port part of a legacy rule: "host:443", "host:8000-8100", "[fd00::/8]:22"
+func splitRulePort(key string) (string, string) {
+	if strings.HasPrefix(key, "[") {
+		end := strings.Index(key, "]")
+		if end < 0 {
+			return key, ""
+		}
+		return key[1:end], strings.TrimPrefix(key[end+1:], ":")
+	}
+	if strings.Count(key, ":") == 1 {
+		i := strings.Index(key, ":")
+		return key[:i], key[i+1:]
+	}
+	return key, "" // no port, or a bare ipv6 address/cidr
+}
+
+// parsePortRange parses "443" or "8000-8100", an empty string means any port
+func parsePortRange(ports string) (int, int, error) {
+	if ports == "" || ports == "*" {
+		return 0, 0, nil
+	}
+	lo, hi := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		lo, hi = ports[:i], ports[i+1:]
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, errors.New("bad port in routing rule: " + ports)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, errors.New("bad port in routing rule: " + ports)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, errors.New("bad port range in routing rule: " + ports)
+	}
+	return min, max, nil
+}
+
+// parseRouteAction parses: local, tether:<id>, reject, direct-via-proxy
+func parseRouteAction(action string) (routeHop, error) {
+	lower := strings.ToLower(strings.TrimSpace(action))
+	switch {
+	case lower == "local" || lower == "localhost":
+		return routeHop{action: actionLocal}, nil
+	case lower == "reject":
+		return routeHop{action: actionReject}, nil
+	case lower == "direct-via-proxy":
+		return routeHop{action: actionDirectViaProxy}, nil
+	case strings.HasPrefix(lower, "tether:") && len(lower) > len("tether:"):
+		return routeHop{action: actionTether, tetherId: strings.TrimSpace(action)[len("tether:"):]}, nil
+	}
+	return routeHop{}, errors.New("unknown routing action: " + action)
+}
+
+// setHostPattern classifies a host glob: exact host, suffix, catch-all or a general glob
+func (r *routeRule) setHostPattern(pattern string) {
+	host := strings.ToLower(pattern)
+	switch {
+	case strings.Trim(host, "*") == "":
+		r.kind = ruleCatchAll
+	case !strings.Contains(host, "*"):
+		r.kind = ruleExact
+		r.host = host
+		if ip := net.ParseIP(host); ip != nil {
+			r.host = ip.String() // so 0:0::1 & ::1 are the same target
+		}
+	case strings.LastIndex(host, "*") == 0:
+		r.kind = ruleSuffix
+		r.host = host[1:]
+		r.specificity = len(r.host)
+	default:
+		parts := strings.Split(host, "*")
+		for i, p := range parts {
+			r.specificity += len(p)
+			parts[i] = regexp.QuoteMeta(p)
+		}
+		r.kind = ruleGlob
+		r.glob = regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	}
+}
+
+// compileRouteConfig compiles an entry of the routes list, an entry without a host, regex or cidr matches every target
+func compileRouteConfig(rc *RouteConfig) (*routeRule, error) {
+	rule := &routeRule{key: rc.String(), kind: ruleCatchAll}
+
+	matchers := 0
+	for _, m := range []string{rc.Host, rc.Regex, rc.Cidr} {
+		if m != "" {
+			matchers++
+		}
+	}
+	if matchers > 1 {
+		return nil, errors.New("routing rule should have only one of host, regex or cidr: " + rule.key)
+	}
+
+	switch {
+	case rc.Host != "":
+		rule.setHostPattern(rc.Host)
+	case rc.Regex != "":
+		reg, err := regexp.Compile(rc.Regex)
+		if err != nil {
+			return nil, errors.New("bad regex in routing rule: " + rule.key)
+		}
+		rule.kind = ruleGlob
+		rule.glob = reg
+	case rc.Cidr != "":
+		_, cidr, err := net.ParseCIDR(rc.Cidr)
+		if err != nil {
+			return nil, errors.New("bad cidr in routing rule: " + rule.key)
+		}
+		rule.kind = ruleCidr
+		rule.cidr = cidr
+		rule.specificity, _ = cidr.Mask.Size()
+	}
+
+	var err error
+	rule.portMin, rule.portMax, err = parsePortRange(rc.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(rc.Balance) {
+	case "", BalanceFailover:
+	case BalanceWeighted:
+		rule.weighted = true
+		rule.sticky = rc.Sticky
+	default:
+		return nil, errors.New("unknown balance in routing rule: " + rule.key)
+	}
+
+	weighted := 0
+	for _, action := range append([]string{rc.Action}, rc.Fallback...) {
+		hop, err := parseRouteAction(action)
+		if err != nil {
+			return nil, errors.New(err.Error() + " in routing rule: " + rule.key)
+		}
+		hop.weight = 1
+		if w, ok := rc.Weights[hop.tetherId]; ok && hop.action == actionTether {
+			if w < 1 {
+				return nil, errors.New("bad weight for " + hop.tetherId + " in routing rule: " + rule.key)
+			}
+			hop.weight = w
+			weighted++
+		}
+		rule.hops = append(rule.hops, hop)
+	}
+	if weighted != len(rc.Weights) {
+		return nil, errors.New("weights for tethers which aren't next hops in routing rule: " + rule.key)
+	}
+	return rule, nil
+}
+
+// hopsFor returns the next hops in the order they are tried for a flow from the given client address.
+// weighted rules put their tether hops first, in an order drawn by weight: each one comes first with a probability
+// proportional to its weight. sticky rules draw it from the client's address (rendezvous hashing), so a client keeps
+// its next hop while it's up, and only the clients of a next hop which went down move to others
+func (r *routeRule) hopsFor(source string) []routeHop {
+	if !r.weighted {
+		return r.hops
+	}
+
+	type scoredHop struct {
+		hop   routeHop
+		score float64
+	}
+	tethers := []scoredHop{}
+	others := []routeHop{}
+	for _, hop := range r.hops {
+		if hop.action != actionTether {
+			others = append(others, hop)
+			continue
+		}
+		var u float64 // uniform in (0, 1]
+		if r.sticky && source != "" {
+			h := fnv.New64a()
+			h.Write([]byte(source + "|" + hop.tetherId))
+			u = (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		} else {
+			u = 1 - rand.Float64()
+		}
+		tethers = append(tethers, scoredHop{hop: hop, score: -math.Log(u) / float64(hop.weight)})
+	}
+	sort.SliceStable(tethers, func(i, j int) bool { return tethers[i].score < tethers[j].score })
+
+	hops := make([]routeHop, 0, len(r.hops))
+	for _, t := range tethers {
+		hops = append(hops, t.hop)
+	}
+	return append(hops, others...)
+}
+
+// mappingToRoute converts an entry of the legacy networkMapping: "<host glob or cidr>[:<ports>]" -> "<clientId>|local",
+// the target may also be an ordered list of next hops: "nodeA,nodeB,local", or a weighted set: "nodeA=3,nodeB=1"
+func mappingToRoute(key, target string) *RouteConfig {
+	host, ports := splitRulePort(strings.TrimSpace(key))
+	rc := &RouteConfig{Ports: ports}
+	if strings.Contains(host, "/") {
+		rc.Cidr = host
+	} else {
+		rc.Host = host
+		if host == "" {
+			rc.Host = "*"
+		}
+	}
+
+	for i, next := range strings.Split(target, ",") {
+		next = strings.TrimSpace(next)
+		if eq := strings.LastIndex(next, "="); eq > 0 {
+			weight, _ := strconv.Atoi(next[eq+1:]) // a bad weight is 0, which is refused when compiled
+			next = next[:eq]
+			if rc.Weights == nil {
+				rc.Weights = map[string]int{}
+			}
+			rc.Weights[next] = weight
+			rc.Balance = BalanceWeighted
+		}
+
+		action := next
+		lower := strings.ToLower(next)
+		if lower != "local" && lower != "localhost" {
+			action = "tether:" + next
+		}
+		if i == 0 {
+			rc.Action = action
+		} else {
+			rc.Fallback = append(rc.Fallback, action)
+		}
+	}
+	return rc
+}
+
+// compileRouteTable compiles the configured routes (kept in their order), followed by the legacy network mapping,
+// and last the routes learned from peers (prefix -> next hops), so a peer's advert never takes
+// traffic our own rules route elsewhere. the mapping and the learned routes are each
+// ordered by specificity: exact host, longest suffix, longest cidr prefix, other globs & then catch-all
+// exports aren't rules, they decide what peers are served & only take precedence over the learned routes
+// bad rules are logged and skipped
+func compileRouteTable(conf *ClientConfig, learned map[string][]string) *routeTable {
+	table := &routeTable{conf: conf}
+	for i := range conf.Routes {
+		rule, err := compileRouteConfig(&conf.Routes[i])
+		if err != nil {
+			logger.Error("compileRouteTable: skipping rule: ", err)
+			continue
+		}
+		table.rules = append(table.rules, rule)
+	}
+
+	if len(conf.Routes) > 0 && len(conf.Mapping) > 0 {
+		logger.Warn("compileRouteTable: both routes & networkMapping are configured, the networkMapping rules are evaluated last")
+	}
+	legacy := []*routeRule{}
+	for key, target := range conf.Mapping {
+		rule, err := compileRouteConfig(mappingToRoute(key, target))
+		if err != nil {
+			logger.Error("compileRouteTable: skipping rule: ", err)
+			continue
+		}
+		rule.key = key
+		legacy = append(legacy, rule)
+	}
+	table.exports = compileExports(conf.NetworkExports)
+	if len(conf.PeerExports) > 0 {
+		table.peerExports = make(map[string][]*routeRule, len(conf.PeerExports))
+		if table.exports == nil {
+			table.exports = []*routeRule{} // peers without exports of their own get nothing
+		}
+	}
+	for peerId, prefixes := range conf.PeerExports {
+		table.peerExports[peerId] = compileExports(prefixes)
+	}
+	advertised := []*routeRule{}
+	for prefix, nextHops := range learned {
+		rc := mappingToRoute(prefix, "local")
+		rc.Action = "tether:" + nextHops[0]
+		for _, via := range nextHops[1:] {
+			rc.Fallback = append(rc.Fallback, "tether:"+via)
+		}
+		rule, err := compileRouteConfig(rc)
+		if err != nil {
+			continue
+		}
+		rule.key = prefix
+		rule.learned = true
+		advertised = append(advertised, rule)
+	}
+
+	sortBySpecificity(legacy)
+	sortBySpecificity(advertised)
+	table.rules = append(table.rules, legacy...)
+	table.rules = append(table.rules, advertised...)
+	return table
+}
+
+// sortBySpecificity puts the most specific rules first
+func sortBySpecificity(rules []*routeRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.specificity != b.specificity {
+			return a.specificity > b.specificity
+		}
+		// a rule for specific ports beats the same rule for any port, and narrower port ranges beat wider ones
+		if (a.portMin != 0) != (b.portMin != 0) {
+			return a.portMin != 0
+		}
+		if a.portMax-a.portMin != b.portMax-b.portMin {
+			return a.portMax-a.portMin < b.portMax-b.portMin
+		}
+		return a.key < b.key
+	})
+}
+
+// compileExports compiles exported prefixes into rules matching the destinations served to peers
+func compileExports(prefixes []string) []*routeRule {
+	if prefixes == nil {
+		return nil
+	}
+	rules := []*routeRule{}
+	for _, prefix := range prefixes {
+		rule, err := compileRouteConfig(mappingToRoute(prefix, "local"))
+		if err != nil {
+			logger.Error("compileRouteTable: skipping export: ", err)
+			continue
+		}
+		rule.key = prefix
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func (r *routeRule) matches(host string, ip net.IP, port int) bool {
+	if r.portMin != 0 && (port < r.portMin || port > r.portMax) {
+		return false
+	}
+	switch r.kind {
+	case ruleExact:
+		return host == r.host
+	case ruleSuffix:
+		return strings.HasSuffix(host, r.host)
+	case ruleCidr:
+		return ip != nil && r.cidr.Contains(ip)
+	case ruleGlob:
+		return r.glob.MatchString(host)
+	default:
+		return true
+	}
+}
+
+// normalizeTarget brings a target to the form rules are matched against: lower case, no trailing dot, canonical ip
+func normalizeTarget(address, port string) (string, net.IP, int) {
+	host := strings.ToLower(strings.TrimSuffix(address, "."))
+	ip := net.ParseIP(host)
+	if ip != nil {
+		host = ip.String()
+	}
+	intPort, _ := strconv.Atoi(port)
+	return host, ip, intPort
+}
+
+// lookup returns the first rule matching the target, or nil if there is none
+func (t *routeTable) lookup(address, port string) *routeRule {
+	host, ip, intPort := normalizeTarget(address, port)
+
+	for _, rule := range t.rules {
+		if rule.matches(host, ip, intPort) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// exported tells if a target may be served to the given peer
+// without any export policy configured everything we route locally is served, as in older versions
+func (t *routeTable) exported(peerId, address, port string) bool {
+	if t.exports == nil {
+		return true
+	}
+	rules, ok := t.peerExports[peerId]
+	if !ok {
+		rules = t.exports
+	}
+	return matchesAny(rules, address, port)
+}
+
+// ownExport tells if a target is one we export, to the peer a task came from or to any peer for our own clients (peerId "")
+// unlike exported it's false without an export policy, nothing is ours to serve then
+func (t *routeTable) ownExport(peerId, address, port string) bool {
+	if t.exports == nil {
+		return false
+	}
+	if peerId == "" {
+		return matchesAny(t.exports, address, port)
+	}
+	return t.exported(peerId, address, port)
+}
+
+func matchesAny(rules []*routeRule, address, port string) bool {
+	host, ip, intPort := normalizeTarget(address, port)
+	for _, rule := range rules {
+		if rule.matches(host, ip, intPort) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,450 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRouteTablePrecedence(t *testing.T) {
+	table := compileRouteTable(&ClientConfig{Mapping: map[string]string{
+		"*":                     "catchAll",
+		"*google*":              "glob",
+		"*.google.com":          "suffix",
+		"*.mail.google.com":     "longerSuffix",
+		"www.google.com":        "exact",
+		"www.google.com:22":     "exactSsh",
+		"10.0.0.0/8":            "cidr8",
+		"10.1.0.0/16":           "cidr16",
+		"10.1.0.0/16:8000-8100": "cidr16ports",
+		"[fd00::/8]:22":         "cidr6ssh",
+		"192.168.1.1":           "exactIp",
+		"bad:port":              "never",
+	}}, nil)
+
+	cases := []struct {
+		host, port, target string
+	}{
+		{"www.google.com", "443", "exact"},
+		{"WWW.Google.com.", "443", "exact"},
+		{"www.google.com", "22", "exactSsh"},
+		{"inbox.mail.google.com", "443", "longerSuffix"},
+		{"maps.google.com", "443", "suffix"},
+		{"google.co.il", "443", "glob"},
+		{"10.1.2.3", "80", "cidr16"},
+		{"10.1.2.3", "8080", "cidr16ports"},
+		{"10.2.2.3", "80", "cidr8"},
+		{"fd00::1", "22", "cidr6ssh"},
+		{"fd00::1", "80", "catchAll"},
+		{"192.168.1.1", "80", "exactIp"},
+		{"192.168.1.10", "80", "catchAll"},
+		{"example.com", "80", "catchAll"},
+	}
+	for _, c := range cases {
+		rule := table.lookup(c.host, c.port)
+		if rule == nil || rule.hops[0].tetherId != c.target {
+			t.Errorf("%s:%s routed by %v, expected %q", c.host, c.port, rule, c.target)
+		}
+	}
+
+	// rules are anchored, no catch-all means no route
+	table = compileRouteTable(&ClientConfig{Mapping: map[string]string{"google.com": "exact"}}, nil)
+	if rule := table.lookup("notgoogle.com", "443"); rule != nil {
+		t.Errorf("unanchored match by: %s", rule.key)
+	}
+}
+
+func TestRouterRecompilesRoutes(t *testing.T) {
+	rtr := NewRouter()
+	rtr.NetworkConfig.Mapping["*"] = "first"
+	if target := rtr.getRouteTable().lookup("example.com", "80").hops[0].tetherId; target != "first" {
+		t.Fatalf("expected first, got: %s", target)
+	}
+
+	// changes in place need an explicit reload, a replaced configuration is picked up by itself
+	rtr.NetworkConfig.Mapping["*"] = "second"
+	rtr.ReloadRoutes()
+	if target := rtr.getRouteTable().lookup("example.com", "80").hops[0].tetherId; target != "second" {
+		t.Fatalf("expected second, got: %s", target)
+	}
+
+	rtr.NetworkConfig = &ClientConfig{Mapping: map[string]string{"*": "third"}}
+	if target := rtr.getRouteTable().lookup("example.com", "80").hops[0].tetherId; target != "third" {
+		t.Fatalf("expected third, got: %s", target)
+	}
+}
+
+func TestRoutesList(t *testing.T) {
+	rtr := NewRouter()
+	rtr.NetworkConfig.ClientId = "self"
+	rtr.NetworkConfig.Routes = []RouteConfig{
+		{Comment: "ssh only through the bastion", Cidr: "10.0.0.0/8", Ports: "22", Action: "tether:bastion", Fallback: []string{"reject"}},
+		{Regex: `^db\d+\.corp$`, Action: "tether:dbNode", Fallback: []string{"tether:self"}},
+		{Host: "*.blocked.com", Action: "reject"},
+		{Host: "*.corp", Action: "tether:corp", Fallback: []string{"tether:bastion", "local"}},
+		{Host: "*.web", Action: "direct-via-proxy", Fallback: []string{"reject"}},
+		{Host: "www.blocked.com", Action: "local"}, // shadowed, routes keep their order
+		{Action: "tether:nowhere"},
+	}
+	rtr.NetworkConfig.Mapping["*"] = "local" // evaluated after the routes, so it never matches here
+
+	cases := []struct {
+		host, port string
+		action     routeAction
+		fails      bool
+	}{
+		{"10.1.1.1", "22", actionReject, false}, // bastion is down, falls back to reject
+		{"db12.corp", "5432", actionLocal, false},
+		{"www.blocked.com", "443", actionReject, false},
+		{"svn.corp", "443", actionLocal, false},
+		{"news.web", "443", actionReject, false}, // no proxy configured
+		{"example.com", "443", actionReject, true},
+	}
+	for _, c := range cases {
+		teth, action, err := rtr.getTargetTether(&TaskInfo{TargetAddress: c.host, TargetPort: c.port})
+		if teth != nil || action != c.action || (err != nil) != c.fails {
+			t.Errorf("%s:%s got action %v, err %v, expected %v", c.host, c.port, action, err, c.action)
+		}
+	}
+
+	rtr.Proxy = &ProxyInfo{Address: "http://localhost:3128"}
+	if _, action, _ := rtr.getTargetTether(&TaskInfo{TargetAddress: "news.web", TargetPort: "443"}); action != actionDirectViaProxy {
+		t.Errorf("expected direct-via-proxy once a proxy is configured, got: %v", action)
+	}
+
+	// the legacy mapping is converted into routes
+	rtr.NetworkConfig.Routes = nil
+	rtr.ReloadRoutes()
+	if _, action, err := rtr.getTargetTether(&TaskInfo{TargetAddress: "example.com", TargetPort: "443"}); err != nil || action != actionLocal {
+		t.Errorf("legacy mapping should route locally, got: %v %v", action, err)
+	}
+
+	if _, err := compileRouteConfig(&RouteConfig{Host: "a.com", Cidr: "10.0.0.0/8", Action: "local"}); err == nil {
+		t.Errorf("a rule with two matchers should be refused")
+	}
+	if _, err := compileRouteConfig(&RouteConfig{Host: "a.com", Action: "teleport"}); err == nil {
+		t.Errorf("a rule with an unknown action should be refused")
+	}
+}
+
+// connectedTether returns a tether with one live connection, over a pipe
+func connectedTether(t *testing.T) *Tether {
+	c1, c2 := net.Pipe()
+	teth := NewTether(true)
+	teth.AddConnection(c1)
+	other := NewMultiMux(false)
+	other.AddConnection(c2)
+	t.Cleanup(func() {
+		teth.Close()
+		other.Close()
+	})
+	return teth
+}
+
+func TestWeightedRoutes(t *testing.T) {
+	rtr := NewRouter()
+	rtr.NetworkConfig.Mapping = map[string]string{
+		"*.ha.corp":    "nodeA,nodeB,local",
+		"*.spread.com": "nodeA=3,nodeB=1",
+	}
+	rtr.NetworkConfig.Routes = []RouteConfig{
+		{Host: "*.sticky.com", Action: "tether:nodeA", Fallback: []string{"tether:nodeB", "reject"}, Balance: BalanceWeighted, Sticky: true},
+	}
+	nodeA, nodeB := connectedTether(t), connectedTether(t)
+	rtr.tethers["nodeA"] = nodeA
+	rtr.tethers["nodeB"] = nodeB
+
+	route := func(host, source string) (*Tether, routeAction) {
+		teth, action, _ := rtr.getTargetTether(&TaskInfo{TargetAddress: host, TargetPort: "443", Source: source})
+		return teth, action
+	}
+
+	// an ordered list fails over
+	if teth, _ := route("svn.ha.corp", ""); teth != nodeA {
+		t.Errorf("the first next hop should be taken while it's up")
+	}
+
+	// a weighted set spreads flows by weight
+	counts := map[*Tether]int{}
+	for i := 0; i < 4000; i++ {
+		teth, _ := route("www.spread.com", "")
+		counts[teth]++
+	}
+	if counts[nodeA] < 2700 || counts[nodeA] > 3300 || counts[nodeA]+counts[nodeB] != 4000 {
+		t.Errorf("flows should be spread 3:1, got %d:%d", counts[nodeA], counts[nodeB])
+	}
+
+	// sticky rules keep a client on the same next hop, and different clients are spread
+	first := map[string]*Tether{}
+	clients := map[*Tether]int{}
+	for i := 0; i < 32; i++ {
+		source := "10.0.0." + strconv.Itoa(i)
+		first[source], _ = route("www.sticky.com", source)
+		for j := 0; j < 5; j++ {
+			if teth, _ := route("www.sticky.com", source); teth != first[source] {
+				t.Fatalf("client %s moved between next hops", source)
+			}
+		}
+		clients[first[source]]++
+	}
+	if clients[nodeA] < 4 || clients[nodeB] < 4 {
+		t.Errorf("sticky clients should be spread over both next hops")
+	}
+
+	// once a next hop is down, its flows fail over, and clients of the other one stay where they are
+	nodeA.Close()
+	for source, teth := range first {
+		if got, _ := route("www.sticky.com", source); got != nodeB {
+			t.Errorf("client %s should fail over to nodeB, was on %v", source, teth == nodeA)
+		}
+	}
+	if teth, _ := route("svn.ha.corp", ""); teth != nodeB {
+		t.Errorf("an ordered list should fail over to the second next hop")
+	}
+	nodeB.Close()
+	if _, action := route("svn.ha.corp", ""); action != actionLocal {
+		t.Errorf("an ordered list should fall back to local, got: %v", action)
+	}
+	if _, action := route("www.sticky.com", "10.0.0.1"); action != actionReject {
+		t.Errorf("a weighted rule should try its other next hops last, got: %v", action)
+	}
+
+	for _, rc := range []RouteConfig{
+		{Action: "tether:a", Balance: "fastest"},
+		{Action: "tether:a", Balance: BalanceWeighted, Weights: map[string]int{"a": 0}},
+		{Action: "tether:a", Balance: BalanceWeighted, Weights: map[string]int{"b": 2}},
+		*mappingToRoute("*", "a=x,b"),
+	} {
+		if _, err := compileRouteConfig(&rc); err == nil {
+			t.Errorf("a bad balanced rule was accepted: %+v", rc)
+		}
+	}
+}
+
+func TestRejectAndProxyActions(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	echoAddr := echo.Addr().(*net.TCPAddr)
+
+	rtr := NewRouter()
+	rtr.Proxy = &ProxyInfo{Address: "http://" + runConnectProxy(t)}
+	rtr.NetworkConfig.Routes = []RouteConfig{
+		{Host: "127.0.0.1", Ports: strconv.Itoa(echoAddr.Port), Action: "direct-via-proxy"},
+		{Action: "reject"},
+	}
+	err = rtr.Serve(ListenerConfig{Port: 10351, Type: "socks5", LocalOnly: true})
+	if err != nil {
+		t.Fatalf("failed to start socks5 listener: %s", err)
+	}
+
+	connect := func(port int) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", "127.0.0.1:10351")
+		if err != nil {
+			t.Fatalf("failed to connect to socks5 listener: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{5, 1, 0})
+		conn.Write(append([]byte{5, ConnectCommand, 0}, socks5AddrBytes("127.0.0.1", port)...))
+		reply := make([]byte, 12)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("no socks5 reply: %s", err)
+		}
+		return conn, reply[3]
+	}
+
+	conn, rep := connect(echoAddr.Port)
+	defer conn.Close()
+	if rep != socks5Success {
+		t.Fatalf("connection through the proxy failed: %d", rep)
+	}
+	conn.Write([]byte("through the proxy"))
+	buf := make([]byte, len("through the proxy"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "through the proxy" {
+		t.Fatalf("bad echo through the proxy: %q %v", buf, err)
+	}
+
+	conn2, rep := connect(echoAddr.Port + 1)
+	defer conn2.Close()
+	if rep != socks5RuleFailure {
+		t.Fatalf("expected a rule failure reply, got: %d", rep)
+	}
+}
+
+func TestExportPolicy(t *testing.T) {
+	table := compileRouteTable(&ClientConfig{
+		Mapping:        map[string]string{"*": "local"},
+		NetworkExports: []string{"*.corp.com", "10.0.0.0/8:22"},
+		PeerExports:    map[string][]string{"partner": {"wiki.corp.com:443"}},
+	}, nil)
+
+	cases := []struct {
+		peer, host, port string
+		exported         bool
+	}{
+		{"anyone", "svn.corp.com", "443", true},
+		{"anyone", "10.1.2.3", "22", true},
+		{"anyone", "10.1.2.3", "80", false},
+		{"anyone", "example.com", "80", false},
+		{"partner", "wiki.corp.com", "443", true},
+		{"partner", "svn.corp.com", "443", false},
+	}
+	for _, c := range cases {
+		if table.exported(c.peer, c.host, c.port) != c.exported {
+			t.Errorf("%s -> %s:%s expected exported: %v", c.peer, c.host, c.port, c.exported)
+		}
+	}
+
+	// without a policy everything routed locally is served, as before exports existed
+	table = compileRouteTable(&ClientConfig{Mapping: map[string]string{"*": "local"}}, nil)
+	if !table.exported("anyone", "example.com", "80") {
+		t.Errorf("no export policy should serve everything")
+	}
+	// per peer exports alone serve nothing to other peers
+	table = compileRouteTable(&ClientConfig{PeerExports: map[string][]string{"partner": {"*"}}}, nil)
+	if table.exported("anyone", "example.com", "80") || !table.exported("partner", "example.com", "80") {
+		t.Errorf("peer exports should only serve their own peer")
+	}
+
+	// exports don't take part in routing, a peer's export doesn't route other peers' tasks here
+	table = compileRouteTable(&ClientConfig{
+		Mapping:        map[string]string{"10.0.0.0/8": "nodeC"},
+		NetworkExports: []string{"10.1.2.3"},
+		PeerExports:    map[string][]string{"nodeA": {"10.1.0.0/16"}},
+	}, nil)
+	if rule := table.lookup("10.1.2.3", "80"); rule == nil || rule.hops[0].tetherId != "nodeC" {
+		t.Errorf("exports should not change the routes, got: %+v", rule)
+	}
+}
+
+func TestRelayedTaskNotExported(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+
+	exit := NewRouter()
+	exit.NetworkConfig.ClientId = "exitNode"
+	exit.NetworkConfig.Mapping["*"] = "local"
+	exit.NetworkConfig.NetworkExports = []string{"127.0.0.1:" + strconv.Itoa(echoPort)}
+	err = exit.Serve(ListenerConfig{Port: 10371, Type: "relayTcp"})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	entry := NewRouter()
+	entry.NetworkConfig.ClientId = "entryNode"
+	entry.NetworkConfig.Mapping["*"] = "exitNode"
+	err = entry.Serve(ListenerConfig{Port: 10372, Type: "socks5", LocalOnly: true})
+	if err != nil {
+		t.Fatalf("failed to start socks5 listener: %s", err)
+	}
+	err = entry.Connect(&TetherConfig{TargetPort: 10371, TargetHost: "localhost", ConnectionType: "tls", Insecure: true}, 2)
+	if err != nil {
+		t.Fatalf("failed to connect tether: %s", err)
+	}
+
+	connect := func(port int) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", "127.0.0.1:10372")
+		if err != nil {
+			t.Fatalf("failed to connect to socks5 listener: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{5, 1, 0})
+		conn.Write(append([]byte{5, ConnectCommand, 0}, socks5AddrBytes("127.0.0.1", port)...))
+		reply := make([]byte, 12)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("no socks5 reply: %s", err)
+		}
+		return conn, reply[3]
+	}
+
+	conn, rep := connect(echoPort)
+	defer conn.Close()
+	if rep != socks5Success {
+		t.Fatalf("connection to an exported destination failed: %d", rep)
+	}
+
+	conn2, rep := connect(echoPort + 1)
+	defer conn2.Close()
+	if rep != socks5RuleFailure {
+		t.Fatalf("expected the exit node to refuse with a rule failure, got: %d", rep)
+	}
+}
+
+func TestRoutingLoopIsRefused(t *testing.T) {
+	// two nodes which route everything to each other
+	nodeB := NewRouter()
+	nodeB.NetworkConfig.ClientId = "loopB"
+	nodeB.NetworkConfig.Mapping["*"] = "loopA"
+	err := nodeB.Serve(ListenerConfig{Port: 10391, Type: "relayTcp"})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	nodeA := NewRouter()
+	nodeA.NetworkConfig.ClientId = "loopA"
+	nodeA.NetworkConfig.Mapping["*"] = "loopB"
+	err = nodeA.Serve(ListenerConfig{Port: 10392, Type: "socks5", LocalOnly: true})
+	if err != nil {
+		t.Fatalf("failed to start socks5 listener: %s", err)
+	}
+	err = nodeA.Connect(&TetherConfig{TargetPort: 10391, TargetHost: "localhost", ConnectionType: "tls", Insecure: true}, 2)
+	if err != nil {
+		t.Fatalf("failed to connect tether: %s", err)
+	}
+
+	connect := func() byte {
+		conn, err := net.Dial("tcp", "127.0.0.1:10392")
+		if err != nil {
+			t.Fatalf("failed to connect to socks5 listener: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{5, 1, 0})
+		conn.Write(append([]byte{5, ConnectCommand, 0}, socks5AddrBytes("example.com", 80)...))
+		reply := make([]byte, 12)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("no socks5 reply: %s", err)
+		}
+		return reply[3]
+	}
+
+	// the task comes back to loopA, which finds itself in the path
+	if rep := connect(); rep != socks5TtlExpired {
+		t.Fatalf("expected a ttl expired reply for a routing loop, got: %d", rep)
+	}
+
+	// loopB refuses the task before returning it once its hop limit is reached
+	nodeB.NetworkConfig.MaxHops = 1
+	if rep := connect(); rep != socks5TtlExpired {
+		t.Fatalf("expected a ttl expired reply for a task over the hop limit, got: %d", rep)
+	}
+	if err := nodeB.checkTaskPath(&TaskInfo{Hops: 1, Path: []string{"loopA"}}); err == nil {
+		t.Fatalf("a task over the hop limit should be refused")
+	}
+}
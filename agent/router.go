@@ -1,30 +1,37 @@
 package agent
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/amitbet/go-socks5"
-	"github.com/amitbet/teleporter/logger"
 	proxy_dialer "github.com/mwitkow/go-http-dialer"
-	//"github.com/pions/dtls"
+	"teleporter/logger"
 )
 
 type IMux interface {
 	Open() (net.Conn, error)
 	Accept() (net.Conn, error)
-	AddConnection(c io.ReadWriteCloser)
+	AddConnection(c io.ReadWriteCloser) error
+	SetOnChange(fn func())
+	Len() int
+	ConnectionLost() <-chan struct{}
+	SetHeartbeat(intervalSecs, timeoutSecs int)
+	SetScheduling(strategy string) error
+	Close() error
+	Closed() <-chan struct{}
+	Drain()
+	DrainConn(remoteAddr string) error
+	Stats() []ConnStats
 }
 
 // Tether is a generalized network connection for tunneling
@@ -33,11 +40,17 @@ type IMux interface {
 type Tether struct {
 	IMux
 	RemoteConfig *ClientConfig
+	Features     *Features // the protocol version & capabilities agreed on with the remote node
+
+	isClient bool
+	size     int    // the number of physical connections the tether should have, 0 for relay side tethers
+	name     string // connection name or address of client side tethers
+	state    TetherState
 }
 
 // NewTether creates a tether which is a generalized network connection for tunneling
 func NewTether(isClient bool) *Tether {
-	t := Tether{}
+	t := Tether{isClient: isClient}
 	t.IMux = NewMultiMux(isClient)
 	return &t
 }
@@ -45,24 +58,24 @@ func NewTether(isClient bool) *Tether {
 // Router holds all connections for the current snap-node, along with the network configuration & routing logic
 // it recieves network connections and routes them to the correct destination
 type Router struct {
-	socks5server       *socks5.Server
 	socks5Credentials  socks5.StaticCredentials
 	tethers            map[string]*Tether
 	NetworkConfig      *ClientConfig
 	mu                 sync.RWMutex
 	AuthenticateSocks5 bool
 	Proxy              *ProxyInfo
+	routes             *routeTable
+	learned            map[string]*peerRoutes // routes advertised by each of our peers
+	routesVersion      int                    // bumped whenever the learned routes change
+	advertOnce         sync.Once
+	advertNow          chan struct{}
+	events             tetherEvents
+	forwards           []ListenerConfig // our reverse forwards
 }
 
 func NewRouter() *Router {
 	rtr := &Router{}
 	rtr.AuthenticateSocks5 = true
-	conf := &socks5.Config{}
-	s5server, err := socks5.New(conf)
-	if err != nil {
-		panic(err)
-	}
-	rtr.socks5server = s5server
 	//rtr.IncomingConns = make(chan *server.TunnelTask, 16)
 	rtr.tethers = make(map[string]*Tether)
 
@@ -79,145 +92,350 @@ func NewRouter() *Router {
 	return rtr
 }
 
-func GenerateSocks5Req(task *TaskInfo) *socks5.Request {
-
-	var ipv4Address = uint8(1)
-	var fqdnAddress = uint8(3)
-	var ipv6Address = uint8(4)
-
-	req := socks5.Request{
-		Version: 5,
-		// Requested command
-		Command: 1,
-		// reserved header byte
-		Reserved: 0,
-		// AuthContext provided during negotiation
-		AuthContext: &socks5.AuthContext{
-			Method:  0,
-			Payload: map[string]string{},
-		},
-		// AddrSpec of the the network that sent the request
-		RemoteAddr: &socks5.AddrSpec{}, // will not be sent anyway
-		// AddrSpec of the desired destination
-		DestAddr: &socks5.AddrSpec{
-			AddressType: ipv4Address, //IPv4 type
-			FQDN:        "",          // unimportant
-			IP:          net.IP{127, 0, 0, 1},
-			Port:        0,
-		},
-	}
-
-	intPort, err := strconv.Atoi(task.TargetPort)
-	if err != nil {
-		logger.Error("GenerateSocks5Req: error in converting port to int:", err)
+// getTargetTether finds the path for a given request (task) and returns the next tether through which it should be routed,
+// when the task is not relayed the tether is nil, and the action says what to do with it instead (execute, reject, use the proxy)
+func (rtr *Router) getTargetTether(taskInf *TaskInfo) (*Tether, routeAction, error) {
+	target := taskInf.TargetAddress + ":" + taskInf.TargetPort
+
+	// tasks addressed to a node several hops away are passed on towards it, the node itself routes them by its own rules
+	if taskInf.TargetNode != "" && taskInf.TargetNode != rtr.NetworkConfig.ClientId {
+		teth, _ := rtr.tetherTowards(taskInf.TargetNode)
+		if teth == nil {
+			errorStr := "no route in router.getTargetTether to node: " + taskInf.TargetNode
+			logger.Error(errorStr)
+			return nil, actionReject, errors.New(errorStr)
+		}
+		return teth, actionTether, nil
 	}
+	taskInf.TargetNode = ""
 
-	req.DestAddr.Port = int(intPort)
-	addr := net.ParseIP(task.TargetAddress)
-	if addr != nil && len(addr) != 0 {
-		req.DestAddr.IP = addr
-		if len(req.DestAddr.IP) == 4 {
-			req.DestAddr.AddressType = ipv4Address
-		} else {
-			req.DestAddr.AddressType = ipv6Address
+	// the peer a task came from is the last node on its path, route() checks the export again by the tether
+	peerId := ""
+	if n := len(taskInf.Path); n > 0 {
+		peerId = taskInf.Path[n-1]
+	}
+
+	//search our routes for the first one matching the target
+	table := rtr.getRouteTable()
+	rule := table.lookup(taskInf.TargetAddress, taskInf.TargetPort)
+
+	// what we export is served here ahead of the routes learned from peers, or nodes exporting the same network
+	// (the exits of an HA pair) would relay each other's tasks until they're refused as a loop
+	if rule != nil && rule.learned && table.ownExport(peerId, taskInf.TargetAddress, taskInf.TargetPort) {
+		logger.Debug("Router.route: Executing locally for exported target: " + target)
+		return nil, actionLocal, nil
+	}
+	if rule == nil {
+		// we didn't find anything explicit in the routes but the client is a local-only socks5 listener
+		if taskInf.Local {
+			logger.Debug("Router.route: Executing locally for target: " + target)
+			return nil, actionLocal, nil
+		}
+		// peers are served the destinations we export to them without a rule of our own
+		if peerId != "" && table.ownExport(peerId, taskInf.TargetAddress, taskInf.TargetPort) {
+			logger.Debug("Router.route: Executing locally for exported target: " + target)
+			return nil, actionLocal, nil
+		}
+		errorStr := "no route in router.getTargetTether for: " + target
+		logger.Error(errorStr)
+		return nil, actionReject, errors.New(errorStr)
+	}
+
+	// take the first next hop which is available, weighted rules order their next hops for each flow
+	for _, hop := range rule.hopsFor(taskInf.Source) {
+		switch hop.action {
+		case actionTether:
+			if hop.tetherId == rtr.NetworkConfig.ClientId { // we found our own name in the routes
+				logger.Debug("Router.route: Executing locally for target: " + target)
+				return nil, actionLocal, nil
+			}
+
+			//lookup the tether by its id, or the peer through which that node can be reached:
+			teth, direct := rtr.tetherTowards(hop.tetherId)
+			if teth == nil {
+				logger.Warn("Router.route: next hop " + hop.tetherId + " is not reachable, for target: " + target)
+				continue
+			}
+			if !direct {
+				taskInf.TargetNode = hop.tetherId
+			}
+			logger.Debug("Router.route: Found route to: " + hop.tetherId + " for target: " + target)
+			return teth, actionTether, nil
+		case actionDirectViaProxy:
+			if rtr.Proxy == nil {
+				logger.Warn("Router.route: no http proxy configured for direct-via-proxy route, for target: " + target)
+				continue
+			}
+			return nil, hop.action, nil
+		default:
+			logger.Debug("Router.route: rule ", rule.key, " for target: "+target)
+			return nil, hop.action, nil
 		}
-	} else {
-		req.DestAddr.AddressType = fqdnAddress
-		req.DestAddr.FQDN = task.TargetAddress
 	}
 
-	return &req
+	//if not found - there is no route, send back an error..
+	errorStr := "thether not found in router.getTargetTether, no next hop is connected for rule: " + rule.key
+	logger.Error(errorStr)
+	return nil, actionReject, errors.New(errorStr)
 }
 
-// getTargetTether finds the path for a given request (task) and returns the next tether through which it should be routed
-func (rtr *Router) getTargetTether(taskInf *TaskInfo) (*Tether, error) {
-	var tID string
+// tetherTowards returns a connected tether leading to the given node, and whether the node is on its other side
+// nodes which aren't directly connected are reached through the peers which advertised them
+func (rtr *Router) tetherTowards(nodeId string) (*Tether, bool) {
+	if teth := rtr.usableTether(nodeId); teth != nil {
+		return teth, true
+	}
 
-	//search our network mapping for any explicit routes
-	for wildcardStr, targetID := range rtr.NetworkConfig.Mapping {
-		regStr := strings.Replace(wildcardStr, "*", ".*?", -1)
-		reg := regexp.MustCompile(regStr)
-		if reg.MatchString(taskInf.TargetAddress) {
-			tID = targetID
-			break
+	for _, via := range rtr.nodeNextHops(nodeId) {
+		if teth := rtr.usableTether(via); teth != nil {
+			return teth, false
 		}
 	}
+	return nil, false
+}
 
-	// for any targets that should be locally executed return nil (local execution)
-	if rtr.NetworkConfig.ClientId == tID || // we found our own name in the map
-		strings.ToLower(tID) == "local" || // we have an explicit local in the map
-		strings.ToLower(tID) == "localhost" ||
-		(tID == "" && taskInf.Local) { // we didn't find anything explicit in the map but the client is a local-only socks5 listener
-		logger.Debug("Router.route: Executing locally for target: " + taskInf.TargetAddress + ":" + taskInf.TargetPort)
-		return nil, nil
+// usableTether returns our tether to a node if it can carry tasks, a tether that is down is skipped even before it's removed
+func (rtr *Router) usableTether(nodeId string) *Tether {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	teth, ok := rtr.tethers[nodeId]
+	if !ok || teth.state == TetherDown || teth.Len() == 0 {
+		return nil
 	}
+	return teth
+}
 
-	logger.Debug("Router.route: Found route to: " + tID + " for target: " + taskInf.TargetAddress + ":" + taskInf.TargetPort)
+// getRouteTable returns the compiled routing rules, compiling them again if the network configuration was replaced
+func (rtr *Router) getRouteTable() *routeTable {
+	rtr.mu.RLock()
+	table := rtr.routes
+	conf := rtr.NetworkConfig
+	version := rtr.routesVersion
+	rtr.mu.RUnlock()
+	if table != nil && table.conf == conf && table.version == version {
+		return table
+	}
+	return rtr.compileRoutes()
+}
 
-	//lookup the tether by its id:
+// ReloadRoutes compiles the routing rules again, it should be called after changing the network mapping in place
+func (rtr *Router) ReloadRoutes() {
+	rtr.compileRoutes()
+	rtr.triggerRouteAdvert()
+}
+
+func (rtr *Router) compileRoutes() *routeTable {
 	rtr.mu.RLock()
-	teth, ok := rtr.tethers[tID]
+	version := rtr.routesVersion
+	table := compileRouteTable(rtr.NetworkConfig, rtr.learnedNextHops())
 	rtr.mu.RUnlock()
 
-	//if not found - there is no route, send back an error..
-	if !ok {
-		errorStr := "thether not found in router.getTargetTether: " + tID
-		logger.Error(errorStr)
-		return nil, errors.New(errorStr)
-	}
-	return teth, nil
+	table.version = version
+	rtr.mu.Lock()
+	rtr.routes = table
+	rtr.mu.Unlock()
+	return table
 }
 
 // route contains the logic which decides where to send the network task once it is acquired
 // it then either relays the task to another node, piping the connections together,
 // or executes the task in the local network
 func (rtr *Router) route(task *TunnelTask) {
-	// if task.Header.Type == TaskTypePing {
-	// 	task.Conn.Write([]byte("Pong"))
-	// 	return
-	// }
+	// pings are answered by whichever node recieves them, they are never routed
+	if task.Header.Type == TaskTypePing {
+		defer task.Close()
+		// the ping stream lives as long as its connection, it mustn't keep a draining connection open
+		if stream, ok := task.Conn.(*trackedStream); ok {
+			stream.untrack()
+		}
+		answerPings(task)
+		return
+	}
+	// so are route adverts, which are only meant for the peer itself
+	if task.Header.Type == TaskTypeRouteAdvert {
+		defer task.Close()
+		err := rtr.receiveRouteAdvert(task)
+		if err != nil {
+			logger.Warn("Router.route: bad route advert: ", err)
+		}
+		return
+	}
+
+	// the path is the sender's claim, the tether it came over only vouches for its last node:
+	// the peer itself, which is also the origin of a task it opened (e.g. a forward asking for its own ports)
+	if n := len(task.Header.Path); task.Peer != "" && (n == 0 || task.Header.Path[n-1] != task.Peer) {
+		logger.Warn("Router.route: refusing task from ", task.Peer, " with a path it doesn't end: ", task.Header.Path)
+		rtr.refuseTask(task, socks5RuleFailure, "task path doesn't end with the peer it came from")
+		return
+	}
+
+	// misconfigured routes could bounce a task between nodes forever
+	if err := rtr.checkTaskPath(task.Header); err != nil {
+		logger.Error("Router.route: ", err)
+		rtr.refuseTask(task, socks5TtlExpired, err.Error())
+		return
+	}
+
+	// forwards addressed to us are served here, and the connections of our own forwards come back to us,
+	// any other tcp task is routed by our rules like a socks task
+	addressedToUs := task.Header.TargetNode == "" || task.Header.TargetNode == rtr.NetworkConfig.ClientId
+	if task.Header.Type == TaskTypeForward && addressedToUs {
+		rtr.listenForward(task)
+		return
+	}
+	if task.Header.Type == TaskTypeTcp && task.Peer != "" && task.Header.TargetNode == rtr.NetworkConfig.ClientId &&
+		rtr.isOwnForward(task.Header) {
+		rtr.taskExec(task)
+		return
+	}
 
-	teth, err := rtr.getTargetTether(task.Header)
+	teth, action, err := rtr.getTargetTether(task.Header)
 	if err != nil {
-		//kill task by not relaying it further
+		//kill task by not relaying it further, telling the client there is no way to its target
 		logger.Error("Router.route Error: no thether - disposing of task")
+		rtr.refuseTask(task, socks5NetUnreachable, err.Error())
 		return
 	}
 
-	if teth == nil {
+	// tasks relayed to us by peers leave the tunnel here only for destinations we export to them
+	if task.Peer != "" && (action == actionLocal || action == actionDirectViaProxy) &&
+		!rtr.getRouteTable().exported(task.Peer, task.Header.TargetAddress, task.Header.TargetPort) {
+		logger.Warn("Router.route: refusing ", task.Peer, ", destination not exported: ", task.Header.TargetAddress+":"+task.Header.TargetPort)
+		rtr.refuseTask(task, socks5RuleFailure, "destination not exported")
+		return
+	}
+
+	switch action {
+	case actionReject:
+		logger.Info("Router.route: rejecting connection to: ", task.Header.TargetAddress+":"+task.Header.TargetPort)
+		rtr.refuseTask(task, socks5RuleFailure, "rejected by routing rule")
+	case actionDirectViaProxy:
+		rtr.executeViaProxy(task)
+	case actionLocal:
 		// ----- if no relay required, execute locally:
-		req := GenerateSocks5Req(task.Header)
-		b := &bytes.Buffer{}
-		req.WriteTo(b)
-		task.PrefixSend(b.Bytes())
-		//b := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-		//task.Read(b)
-		//logger.Fatal(b)
 		rtr.taskExec(task)
-	} else {
+	default:
 		// ----- relay the task to the next node:
-		logger.Info("chosen route:", teth.RemoteConfig.ClientId)
+		logger.Info("chosen route:", rtr.tetherId(teth))
+		if task.Header.Type == TaskTypeUdp && !rtr.tetherSupports(teth, capUdp) {
+			logger.Warn("Router.route: ", rtr.tetherId(teth), " doesn't support udp, dropping flow to: ", task.Header.TargetAddress)
+			task.Close()
+			return
+		}
+		if (task.Header.Type == TaskTypeForward || task.Header.Type == TaskTypeTcp) && !rtr.tetherSupports(teth, capForward) {
+			logger.Warn("Router.route: ", rtr.tetherId(teth), " doesn't support forwards, dropping connection to: ", task.Header.TargetAddress)
+			rtr.refuseTask(task, socks5CmdNotSupported, "forwards are not supported by "+rtr.tetherId(teth))
+			return
+		}
 
 		//add the task info to the stream for the other side to route.
-		task.PrefixTaskInfo()
+		task.Header.Hops++
+		task.Header.Path = append(task.Header.Path, rtr.NetworkConfig.ClientId)
+		err = task.PrefixTaskInfo()
+		if err != nil {
+			logger.Error("Router.route: can't relay the task to: ", task.Header.TargetAddress, ", ", err)
+			rep := socks5ServerFailure
+			if errors.Is(err, errHeaderTarget) {
+				rep = socks5AddrNotSupported
+			}
+			rtr.refuseTask(task, rep, err.Error())
+			return
+		}
 		rtr.taskRelay(task, teth)
 	}
 }
 
+// replyTask answers a socks task: with a socks5 reply when the client is ours, or with a status frame which
+// travels back to the entry node when the task was relayed to us (datagram flows get no answer)
+// the node which opened a forward task reads a status, even when the task fails on that node
+func (rtr *Router) replyTask(task *TunnelTask, rep uint8, bind net.Addr, reason string) error {
+	switch {
+	case task.Header.Type == TaskTypeForward:
+	case task.Header.Type != TaskTypeSocks:
+		return nil
+	case task.Peer == "":
+		return task.answerClient(rep, bind)
+	}
+	status := &taskStatus{Rep: rep, Node: rtr.NetworkConfig.ClientId, Reason: reason}
+	if bind != nil {
+		status.Bind = bind.String()
+	}
+	return writeTaskStatus(task, status)
+}
+
+// checkTaskPath refuses tasks which already passed through this node, or through too many relays
+func (rtr *Router) checkTaskPath(taskInf *TaskInfo) error {
+	maxHops := rtr.NetworkConfig.MaxHops
+	if maxHops <= 0 {
+		maxHops = defaultMaxHops
+	}
+	path := strings.Join(taskInf.Path, " -> ")
+	target := taskInf.TargetAddress + ":" + taskInf.TargetPort
+	if pathContains(taskInf.Path, rtr.NetworkConfig.ClientId) {
+		return errors.New("routing loop for " + target + ", path: " + path + " -> " + rtr.NetworkConfig.ClientId)
+	}
+	if taskInf.Hops >= maxHops {
+		return errors.New("hop limit exceeded for " + target + ", path: " + path + " -> " + rtr.NetworkConfig.ClientId)
+	}
+	return nil
+}
+
+// refuseTask answers the client with a socks5 failure reply and disposes of the task
+func (rtr *Router) refuseTask(task *TunnelTask, rep uint8, reason string) {
+	rtr.replyTask(task, rep, nil, reason)
+	task.Close()
+}
+
+// executeViaProxy connects to the target through the node's http proxy, instead of dialing it directly
+func (rtr *Router) executeViaProxy(task *TunnelTask) {
+	defer task.Close()
+	if task.Header.Type == TaskTypeUdp {
+		logger.Warn("Router.executeViaProxy: http proxies can't carry udp, dropping flow to: ", task.Header.TargetAddress)
+		return
+	}
+
+	target := net.JoinHostPort(task.Header.TargetAddress, task.Header.TargetPort)
+	conn, err := dialTcp(target, rtr.Proxy)
+	if err != nil {
+		logger.Error("Router.executeViaProxy: failed connecting through the proxy to: ", target, err)
+		rtr.replyTask(task, socks5HostUnreachable, nil, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	err = rtr.replyTask(task, socks5Success, conn.LocalAddr(), "")
+	if err != nil {
+		return
+	}
+	errCh := make(chan error, 2)
+	go proxy(task, conn, errCh)
+	go proxy(conn, task, errCh)
+	<-errCh
+}
+
 // taskRelay will relay the task to the network node dscribed by the target parameter
 func (rtr *Router) taskRelay(task *TunnelTask, targ *Tether) error {
+	defer task.Conn.Close()
 	muxConn, err := targ.Open()
 	if err != nil {
 		logger.Error("Error establishing session", err)
+		rtr.replyTask(task, socks5NetUnreachable, nil, err.Error())
 		return err
 	}
 
 	defer muxConn.Close()
-	defer task.Conn.Close()
 
 	//send all prebuffered content down the line
 	muxConn.Write(task.ReadPresend())
 
+	// our own socks clients get their reply from the status the task's journey ended with
+	if task.Peer == "" && task.Header.Type == TaskTypeSocks {
+		err = rtr.answerFromStatus(task, muxConn)
+		if err != nil {
+			return err
+		}
+	}
+
 	//From now on proxy everything
 	errCh := make(chan error, 2)
 	go proxy(task.Conn, muxConn, errCh)
@@ -250,41 +468,141 @@ func proxy(dst io.Writer, src io.Reader, errCh chan error) {
 	errCh <- err
 }
 
+// answerFromStatus waits for the status of a relayed socks task and answers the client with the matching socks5 reply
+func (rtr *Router) answerFromStatus(task *TunnelTask, muxConn net.Conn) error {
+	status, err := readTaskStatus(muxConn)
+	if err != nil {
+		logger.Error("Router.answerFromStatus: no status from relay for: ", task.Header.TargetAddress, err)
+		task.answerClient(socks5ServerFailure, nil)
+		return err
+	}
+	err = task.answerClient(status.Rep, status.bindAddr())
+	if err != nil {
+		return err
+	}
+	if status.Rep != socks5Success {
+		logger.Warn("Router.answerFromStatus: ", status.Node, " failed task for: ", task.Header.TargetAddress+":"+task.Header.TargetPort, ", ", status.Reason)
+		return errors.New("task failed at " + status.Node + ": " + status.Reason)
+	}
+	return nil
+}
+
 // taskExec will run the task with the local server, performing the request inside the current network
-// it can have several modes of operation (socks5, vpn, htmlproxy), currently only socks5 is implemented.
+// it has two modes of operation: connecting (socks5, http proxy, forwarded & vpn tcp connections) and udp flows.
 func (rtr *Router) taskExec(task *TunnelTask) {
-	rtr.executeAsSocks5(task)
+	if task.Header.Type == TaskTypeUdp {
+		rtr.executeUdp(task)
+		return
+	}
+
+	rtr.executeConnect(task)
+}
+
+// executeConnect dials the target of a socks task and pipes the task to it, the dial's outcome is sent back as a reply
+func (rtr *Router) executeConnect(task *TunnelTask) {
+	defer task.Close()
+	target := net.JoinHostPort(task.Header.TargetAddress, task.Header.TargetPort)
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		logger.Error("Router.executeConnect: failed connecting to: ", target, err)
+		rtr.replyTask(task, dialErrorReply(err), nil, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	err = rtr.replyTask(task, socks5Success, conn.LocalAddr(), "")
+	if err != nil {
+		return
+	}
+	errCh := make(chan error, 2)
+	go proxy(task, conn, errCh)
+	go proxy(conn, task, errCh)
+	<-errCh
 }
 
 // Connect creates a new bundle of physical connections to the server (AKA: thether)
+// the bundle is then kept at its configured size by a supervisor which redials any connection that dies,
+// this happens even if the initial connection attempt fails (in which case the error is still returned)
 func (rtr *Router) Connect(connConf *TetherConfig, numConnsPerTether int) error {
-	proxy := connConf.Proxy
-	serverAddress := connConf.TargetHost + ":" + strconv.Itoa(connConf.TargetPort)
+	// keep our own copy, the supervisor holds on to it for the lifetime of the tether
+	conf := *connConf
+	serverAddress := conf.TargetHost + ":" + strconv.Itoa(conf.TargetPort)
 	if numConnsPerTether <= 0 {
 		numConnsPerTether = 10
 	}
 
-	teth, err := rtr.createMultiConn(serverAddress, connConf, numConnsPerTether, proxy)
-	if err != nil {
-		logger.Error("Connect: problem while connecting the tether to server:", serverAddress, err)
+	teth := NewTether(true)
+	teth.SetHeartbeat(conf.HeartbeatIntervalSecs, conf.HeartbeatTimeoutSecs)
+	if err := teth.SetScheduling(conf.Scheduling); err != nil {
 		return err
 	}
-
-	if strings.TrimSpace(teth.RemoteConfig.ClientId) == "" {
-		logger.Error("Connect: bad clientID while connecting tether to server:", serverAddress)
-		return fmt.Errorf("Connect: bad clientID while connecting tether to server: %s", serverAddress)
+	teth.size = numConnsPerTether
+	teth.name = conf.ConnectionName
+	if teth.name == "" {
+		teth.name = serverAddress
+	}
+	rtr.watchTether(teth)
+	err := rtr.createMultiConn(teth, serverAddress, &conf, numConnsPerTether)
+	if err != nil {
+		logger.Error("Connect: problem while connecting the tether to server, will keep retrying:", serverAddress, err)
 	}
 
-	rtr.mu.Lock()
-	rtr.tethers[teth.RemoteConfig.ClientId] = teth
-	rtr.mu.Unlock()
+	sup := &tetherSupervisor{
+		rtr:           rtr,
+		teth:          teth,
+		conf:          &conf,
+		serverAddress: serverAddress,
+		size:          numConnsPerTether,
+	}
 	go rtr.handleIncomingConnections(teth)
+	go sup.run()
 	return err
 }
 
+// registerTether (re)publishes a client side tether in the routing table under the id reported by the remote node
+func (rtr *Router) registerTether(teth *Tether, remoteConf *ClientConfig, features *Features) error {
+	if strings.TrimSpace(remoteConf.ClientId) == "" {
+		return errors.New("registerTether: remote node reported an empty clientId")
+	}
+
+	rtr.mu.Lock()
+	defer rtr.mu.Unlock()
+	if teth.RemoteConfig != nil && teth.RemoteConfig.ClientId != remoteConf.ClientId && rtr.tethers[teth.RemoteConfig.ClientId] == teth {
+		delete(rtr.tethers, teth.RemoteConfig.ClientId)
+	}
+	teth.RemoteConfig = remoteConf
+	if !features.Has(capKeepalive) {
+		// the relay wouldn't answer, every connection would be torn down
+		teth.SetHeartbeat(0, 0)
+	}
+	teth.Features = features
+	rtr.tethers[remoteConf.ClientId] = teth
+	return nil
+}
+
+// tetherSupports tells if a capability was agreed on with the node on the other side of the tether
+func (rtr *Router) tetherSupports(teth *Tether, capability string) bool {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	return teth.Features.Has(capability)
+}
+
+// tetherId returns the id of the node on the other side of the tether
+func (rtr *Router) tetherId(teth *Tether) string {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	if teth.RemoteConfig == nil {
+		return ""
+	}
+	return teth.RemoteConfig.ClientId
+}
+
 // Serve creates a listener of given type and runs it on the given port
 func (rtr *Router) Serve(serverConf ListenerConfig) error {
 	port := strconv.Itoa(serverConf.Port)
+	if _, ok := schedulers[serverConf.Scheduling]; serverConf.Scheduling != "" && !ok {
+		return errors.New("unknown stream scheduling strategy: " + serverConf.Scheduling)
+	}
 	switch serverConf.Type {
 	case "socks5": // opens a socks 5 proxy port for browsers / native clients
 		// an entry point for incoming traffic
@@ -301,40 +619,113 @@ func (rtr *Router) Serve(serverConf ListenerConfig) error {
 			logger.Error("problem with listening to port: ", port, err)
 			return err
 		}
-		go rtr.handleSocksListener(socks5Listener)
+		udpIdleTimeout := time.Duration(serverConf.UdpIdleTimeoutSecs) * time.Second
+		go rtr.handleSocksListener(socks5Listener, udpIdleTimeout)
 	case "relayTcp": // opens a multi-mux tcp port, executes locally or realys messages to other connections
 		// tcp is a solid default to start from
 		listenAddr := ":" + port
-		controlListener, err := createTlsControlListener(listenAddr)
+		controlListener, err := createTlsControlListener(listenAddr, &serverConf)
 		if err != nil {
 			logger.Error("problem with listening to port: ", port, err)
 			return err
 		}
 		go rtr.handleControlListener(controlListener, &serverConf)
 	case "relayUdp":
-		// udp is good for performance
-		// listenAddr := ":" + port
-		// controlListener1, err := createDtlsControlListener(listenAddr)
-		// if err != nil {
-		// 	logger.Error("problem with listening to port: ", port, err)
-		// 	return err
-		// }
-		// go rtr.handleControlListener(controlListener1, &serverConf)
+		// udp (quic) degrades gracefully on lossy links, no head of line blocking on retransmits at the tcp level
+		listenAddr := ":" + port
+		controlListener, err := createQuicControlListener(listenAddr, &serverConf)
+		if err != nil {
+			logger.Error("problem with listening to port: ", port, err)
+			return err
+		}
+		go rtr.handleControlListener(controlListener, &serverConf)
 	case "relayWebSockets":
-		// ws is good for passing firewalls
-		return errors.New("Not implemented")
+		// ws is good for passing firewalls, carries the same handshake & muxado framing as relayTcp
+		listenAddr := ":" + port
+		controlListener, err := createWebSocketControlListener(listenAddr, &serverConf)
+		if err != nil {
+			logger.Error("problem with listening to port: ", port, err)
+			return err
+		}
+		go rtr.handleControlListener(controlListener, &serverConf)
+	case "httpProxy": // an entry point for clients which honour HTTP_PROXY / HTTPS_PROXY but not socks5
+		listenAddr := ":" + port
+		if serverConf.LocalOnly {
+			listenAddr = "localhost" + listenAddr
+		}
+		listener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			logger.Error("problem with listening to port: ", port, err)
+			return err
+		}
+		go rtr.handleHttpProxyListener(listener, &serverConf)
+	case "transparent": // an entry point for connections redirected by the firewall (iptables REDIRECT), linux only
+		if !transparentSupported {
+			return errTransparentUnsupported
+		}
+		listenAddr := ":" + port
+		if serverConf.LocalOnly {
+			listenAddr = "localhost" + listenAddr
+		}
+		listener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			logger.Error("problem with listening to port: ", port, err)
+			return err
+		}
+		go rtr.handleTransparentListener(listener)
+	case "tun": // a vpn: the tcp connections & udp flows the os routes into the tun device are routed like socks5 ones
+		if !tunSupported {
+			return errTunUnsupported
+		}
+		err := rtr.startTun(serverConf)
+		if err != nil {
+			logger.Error("problem with tun listener: ", err)
+			return err
+		}
+	case "portForward": // a plain tcp port, its connections are routed to a fixed target like socks5 connections
+		host, targetPort, err := splitForwardTarget(serverConf.Target)
+		if err != nil {
+			return errors.New("bad target for portForward listener: " + serverConf.Target)
+		}
+		listenAddr := ":" + port
+		if serverConf.LocalOnly {
+			listenAddr = "localhost" + listenAddr
+		}
+		listener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			logger.Error("problem with listening to port: ", port, err)
+			return err
+		}
+		go rtr.handlePortForwardListener(listener, host, targetPort)
+	case "forward": // opens a port on a remote node, its connections are tunneled back to a target reachable from here
+		err := rtr.startReverseForward(serverConf)
+		if err != nil {
+			logger.Error("problem with forward listener: ", err)
+			return err
+		}
 	default:
 		return errors.New("Unknown server type: " + serverConf.Type)
 	}
 	return nil
 }
 
+// acceptRetryDelay paces the control listener after a temporary Accept failure (e.g. out of file descriptors)
+const acceptRetryDelay = 100 * time.Millisecond
+
+// handleControlListener accepts physical connections until the listener is closed
 func (rtr *Router) handleControlListener(controlListener net.Listener, serverConf *ListenerConfig) {
 	defer controlListener.Close()
 	for {
 		conn, err := controlListener.Accept()
 		if err != nil {
+			// a closed listener (tcp, websocket or quic) fails every Accept from now on
+			var ne net.Error
+			if errors.Is(err, net.ErrClosed) || !errors.As(err, &ne) || !ne.Temporary() {
+				logger.Debug("control listener stopped: ", err)
+				return
+			}
 			logger.Error("TCP accept failed: %s\n", err)
+			time.Sleep(acceptRetryDelay)
 			continue
 		}
 		go rtr.handlePhysicalClientConn(conn, serverConf)
@@ -342,7 +733,7 @@ func (rtr *Router) handleControlListener(controlListener net.Listener, serverCon
 }
 
 func readNetConfig(conn net.Conn) (*ClientConfig, error) {
-	clientConfigStr, err := ReadString(conn)
+	clientConfigStr, err := ReadLimitedString(conn, maxJsonMessageSize)
 	if err != nil {
 		logger.Error("Client connect, failed while reading client header: %s\n", err)
 		return nil, err
@@ -358,8 +749,10 @@ func readNetConfig(conn net.Conn) (*ClientConfig, error) {
 	return &cconfig, nil
 }
 
-func writeNetConfig(conn net.Conn, config *ClientConfig) error {
-	jstr, err := json.Marshal(config)
+// writeNetConfig introduces this node to a peer, which only uses its id:
+// routes, mappings, exports & forward ports describe our network & are never sent
+func writeNetConfig(conn net.Conn, clientId string) error {
+	jstr, err := json.Marshal(&ClientConfig{ClientId: clientId})
 	if err != nil {
 		logger.Error("writeNetConfig: problem in netConfig json marshaling: ", err)
 		return err
@@ -373,12 +766,30 @@ func writeNetConfig(conn net.Conn, config *ClientConfig) error {
 }
 
 // handlePhysicalClientConn manages a new physical (non-mux) client connection comming into the control port
-// it reads the client configuration, answers with our node's config, and adds the connection to the correct multi-mux conn pool
+// it authenticates the client, exchanges configurations with it, and adds the connection to the correct multi-mux conn pool
 func (rtr *Router) handlePhysicalClientConn(conn net.Conn, serverConf *ListenerConfig) {
+	// a peer that connects but never completes the handshake should not hold on to the connection
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	// nothing about this node is revealed before the client proves who it is
+	cid, err := authenticateClient(conn, serverConf)
+	if err != nil {
+		logger.Warn("handlePhysicalClientConn: authentication failed: ", err)
+		conn.Close()
+		return
+	}
+
+	features, err := helloAsRelay(conn)
+	if err != nil {
+		logger.Error("handlePhysicalClientConn: refusing client ", cid, ": ", err)
+		conn.Close()
+		return
+	}
 
-	err := writeNetConfig(conn, rtr.NetworkConfig)
+	err = writeNetConfig(conn, rtr.NetworkConfig.ClientId)
 	if err != nil {
 		logger.Error("handlePhysicalClientConn: error writing netConfig", err)
+		conn.Close()
 		return
 	}
 
@@ -386,63 +797,66 @@ func (rtr *Router) handlePhysicalClientConn(conn net.Conn, serverConf *ListenerC
 	cconfig, err := readNetConfig(conn)
 	if err != nil {
 		logger.Error("handlePhysicalClientConn: error reading netConfig from client", err)
+		conn.Close()
+		return
+	}
+	if cconfig.ClientId != cid {
+		logger.Warn("handlePhysicalClientConn: client authenticated as: " + cid + " but sent the config of: " + cconfig.ClientId)
+		conn.Close()
 		return
 	}
 
-	cid := cconfig.ClientId
+	conn.SetDeadline(time.Time{})
 	logger.Info("Client connected, id: ", cid)
 
-	if serverConf.UseAuthentication {
-		if serverConf.AuthorizedClients[cid] != cconfig.Secret {
-			logger.Warn("Authentication error, bad password for clientId: " + cid)
-			conn.Close()
-			return
-		}
-	}
 	// Setup server side of muxado
 	// session := muxado.Server(conn, nil)
 	// defer session.Close()
 
-	var teth *Tether
-	var ok bool
-	rtr.mu.RLock()
-	teth, ok = rtr.tethers[cid]
-	rtr.mu.RUnlock()
-
-	//TODO: go over goroutines, and inspect creation and deletion
+	heartbeatInterval := serverConf.HeartbeatIntervalSecs
+	if !features.Has(capKeepalive) {
+		heartbeatInterval = 0 // the client wouldn't answer, every connection would be torn down
+	}
 
-	// if this is a first connection to some node in the netowrk, create a new tether to represent it
-	if !ok {
-		//create new Client
-		teth = NewTether(false)
-		teth.RemoteConfig = cconfig
+	// a tether whose last connection just died is removed & closed, the connection then goes to a new one
+	for {
+		// lookup & creation happen under one lock, a reconnecting client dials several connections at once
 		rtr.mu.Lock()
-		rtr.tethers[cid] = teth
+		teth, ok := rtr.tethers[cid]
+		if !ok {
+			// if this is a first connection to some node in the netowrk, create a new tether to represent it
+			teth = NewTether(false)
+			teth.SetScheduling(serverConf.Scheduling) // checked when the listener was started
+			rtr.tethers[cid] = teth
+		}
+		teth.RemoteConfig = cconfig
+		teth.Features = features
 		rtr.mu.Unlock()
+		teth.SetHeartbeat(heartbeatInterval, serverConf.HeartbeatTimeoutSecs)
+		if !ok {
+			rtr.watchTether(teth)
+			go rtr.handleIncomingConnections(teth)
+		}
 
-		//TODO: cleanup and close all connections when listener is destroyed, think of dead conns and reconnect
-		//TODO: check that incoming mux conns are closed and that go routines handling them end as expected
-		//TODO: add some keepalive mechanism
-		teth.AddConnection(conn)
-		go rtr.handleIncomingConnections(teth)
-	} else {
-		// a known node, add an additional connection to an existing tether
-		teth.AddConnection(conn)
-		teth.RemoteConfig = cconfig
+		//TODO: cleanup and close all connections when listener is destroyed
+		err = teth.AddConnection(conn)
+		if err == ErrMuxClosed {
+			continue
+		}
+		break
 	}
-
+	rtr.triggerRouteAdvert()
 }
 
 // createTlsControlListener creates a listener of type: tcpRelay (with encryption = tls)
-func createTlsControlListener(listenAddress string) (net.Listener, error) {
+func createTlsControlListener(listenAddress string, serverConf *ListenerConfig) (net.Listener, error) {
 	var controlListener net.Listener
 	var err error
 
-	cer, err := tls.LoadX509KeyPair("server.crt", "server.key")
+	tlsconfig, err := serverTlsConfig(serverConf)
 	if err != nil {
 		return nil, err
 	}
-	tlsconfig := &tls.Config{Certificates: []tls.Certificate{cer}}
 
 	controlListener, err = tls.Listen("tcp", listenAddress, tlsconfig)
 
@@ -454,58 +868,6 @@ func createTlsControlListener(listenAddress string) (net.Listener, error) {
 	return controlListener, nil
 }
 
-// createDtlsControlListener creates a listener of type: udpRelay (with encryption = dtls)
-// func createDtlsControlListener(listenAddress string) (net.Listener, error) {
-// 	var controlListener net.Listener
-// 	var err error
-
-// 	logger.Debug("createControlListener: running on dtls")
-// 	addr, err := net.ResolveUDPAddr("udp", listenAddress)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	certificate, privateKey, err := dtls.GenerateSelfSigned()
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	// Prepare the configuration of the DTLS connection
-// 	config := &dtls.Config{Certificate: certificate, PrivateKey: privateKey}
-
-// 	// Connect to a DTLS server
-// 	controlListener, err = dtls.Listen("udp", addr, config)
-
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	logger.Debug("createControlListener: Started server at " + listenAddress)
-// 	return controlListener, nil
-// }
-
-func (rtr *Router) executeAsSocks5(muxConn *TunnelTask) {
-	// read request from connection:
-	request, err := socks5.NewRequest(muxConn)
-	if err != nil {
-		logger.Error("Router.executeAsSocks5: Error: ", err)
-		return
-	}
-
-	defer muxConn.Close()
-
-	// Process the client request
-	if err := rtr.socks5server.HandleRequest(request, muxConn); err != nil {
-		logger.Error("Failed to handle request", err)
-		return
-	}
-
-	return
-	//start socks5 connection handler
-
-	//read the auth answer
-	//reply := []byte{0, 0}
-	//io.ReadAtLeast(muxConn.Conn, reply, 2)
-}
-
 // runPingLoop periodically pings the other side
 // and listen for the reply, which should be recieved within a certain time period
 // func runPingLoop(intervalSecs, timeoutSecs int, conn net.Conn) error {
@@ -526,38 +888,75 @@ func (rtr *Router) executeAsSocks5(muxConn *TunnelTask) {
 // 	return nil
 // }
 
-// createMultiConn opens multiple connections to the given server
-func (rtr *Router) createMultiConn(serverAddress string, tConf *TetherConfig, connCountInBundle int, proxyInfo *ProxyInfo) (*Tether, error) {
-	myConf := *rtr.NetworkConfig
-	myConf.Secret = tConf.ClientPassword
-
-	jstr, err := json.Marshal(myConf)
-	if err != nil {
-		logger.Error("createMultiConn: problem in network config json marshaling: ", err)
-	}
-
-	th := NewTether(true)
+// createMultiConn opens multiple connections to the given server and adds them to the tether
+func (rtr *Router) createMultiConn(th *Tether, serverAddress string, tConf *TetherConfig, connCountInBundle int) error {
 	for i := 0; i < connCountInBundle; i++ {
-		conn1 := dialConnection(tConf.ConnectionType, serverAddress, proxyInfo)
-
-		// read ID & config from the client
-		cconfig, err := readNetConfig(conn1)
+		conn1, cconfig, features, err := rtr.dialTetherConn(serverAddress, tConf)
 		if err != nil {
-			logger.Error("createMultiConn: problem in reading client's network config: ", err)
-			return nil, err
+			return err
 		}
-		th.RemoteConfig = cconfig
 
-		// write the client ID & Configuration to the server
-		err = WriteString(conn1, string(jstr))
+		err = rtr.registerTether(th, cconfig, features)
 		if err != nil {
-			logger.Error("createMultiConn: problem in sending server's network config: ", err)
-			return nil, err
+			logger.Error("createMultiConn: bad clientID while connecting tether to server:", serverAddress)
+			conn1.Close()
+			return err
 		}
+		err = th.AddConnection(conn1)
+		if err != nil {
+			conn1.Close()
+			return err
+		}
+		rtr.triggerRouteAdvert()
+	}
+	return nil
+}
 
-		th.AddConnection(conn1)
+// dialTetherConn opens a single physical connection to the server and performs the net-config handshake on it
+func (rtr *Router) dialTetherConn(serverAddress string, tConf *TetherConfig) (net.Conn, *ClientConfig, *Features, error) {
+	clientId := rtr.NetworkConfig.ClientId
+
+	conn, err := dialConnection(tConf, serverAddress)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	return th, nil
+
+	// a peer that accepts the connection but never answers should not hang the caller
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	// the password only ever goes into the handshake's mac, it is never sent
+	err = authenticateToServer(conn, clientId, tConf.ClientPassword)
+	if err != nil {
+		logger.Error("dialTetherConn: authentication with the relay failed: ", err)
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	features, err := helloAsTether(conn)
+	if err != nil {
+		logger.Error("dialTetherConn: refusing relay: ", err)
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	// read ID & config from the server
+	cconfig, err := readNetConfig(conn)
+	if err != nil {
+		logger.Error("dialTetherConn: problem in reading server's network config: ", err)
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	// write the client ID & Configuration to the server
+	err = writeNetConfig(conn, clientId)
+	if err != nil {
+		logger.Error("dialTetherConn: problem in sending our network config: ", err)
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, cconfig, features, nil
 }
 
 // HandleClientConnection runs the accept loop on the client side multi-mux (tether),
@@ -573,77 +972,73 @@ func (rtr *Router) handleIncomingConnections(sess *Tether) {
 		logger.Debug("mux connection accepted")
 		task, err := ReadTunnelTask(sconn)
 		if err != nil {
+			// a bad stream is dropped, the tether itself is fine
 			logger.Error("failed to read task from connection", err)
-			break
+			sconn.Close()
+			continue
 		}
+		task.Peer = rtr.tetherId(sess)
 
 		go rtr.route(task)
 	}
 }
 
 // dialConnection opens a single connection to the server
-func dialConnection(typ string, serverAddress string, proxy *ProxyInfo) net.Conn {
-
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: true,
+func dialConnection(tConf *TetherConfig, serverAddress string) (net.Conn, error) {
+	tlsconfig, err := clientTlsConfig(tConf, serverAddress)
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
 	var conn net.Conn
+	typ := tConf.ConnectionType
 	if typ == "tls" {
-
-		if proxy != nil {
-			u, err := url.Parse(proxy.Address)
-			if err != nil {
-				logger.Error("failed parsing httpProxyListener into URL", err)
-			}
-
-			proxyDialer := proxy_dialer.New(u, proxy_dialer.WithTls(tlsconfig))
-			if proxy.User != "" || proxy.Pass != "" {
-				prxAuth := proxy_dialer.WithProxyAuth(proxy_dialer.AuthBasic(proxy.User, proxy.Pass))
-				prxAuth(proxyDialer)
-			}
-
-			rawConn, err := proxyDialer.Dial("tcp", serverAddress)
-			if err != nil {
-				logger.Error("Cannot connect to target: ", err)
-				os.Exit(0)
-			}
-			conn = tls.Client(rawConn, tlsconfig)
-
-			if err != nil {
-				logger.Error("Cannot estabilsh tls: ", err)
-				os.Exit(0)
-			}
-		} else {
-			conn, err = tls.Dial("tcp", serverAddress, tlsconfig)
+		rawConn, err := dialTcp(serverAddress, tConf.Proxy)
+		if err != nil {
+			logger.Error("Cannot connect to target: ", err)
+			return nil, err
 		}
-
+		conn = tls.Client(rawConn, tlsconfig)
+	} else if typ == "ws" || typ == "wss" {
+		conn, err = dialWebSocket(tConf, serverAddress, tlsconfig)
+		if err != nil {
+			logger.Error("Cannot connect to target: ", err)
+			return nil, err
+		}
+	} else if typ == "quic" {
+		if tConf.Proxy != nil {
+			logger.Warn("dialConnection: http proxies can't carry udp, dialing quic directly to: ", serverAddress)
+		}
+		conn, err = dialQuic(serverAddress, tlsconfig)
 		if err != nil {
 			logger.Error("Cannot connect to target: ", err)
-			os.Exit(0)
+			return nil, err
 		}
-	} else if typ == "dtls" {
-		// logger.Debug("running on dtls")
-		// addr, err := net.ResolveUDPAddr("udp", serverAddress)
-		// if err != nil {
-		// 	logger.Error("Cannot resolve address: ", serverAddress, err)
-		// 	os.Exit(0)
-		// }
+	} else {
+		return nil, errors.New("dialConnection: unknown connection type: " + typ)
+	}
+	return conn, nil
+}
 
-		// // Generate a certificate and private key to secure the connection
-		// certificate, privateKey, err := dtls.GenerateSelfSigned()
-		// if err != nil {
-		// 	panic(err)
-		// }
+// dialTcp opens a raw tcp connection to the server, going through the http proxy if one is given
+func dialTcp(serverAddress string, proxy *ProxyInfo) (net.Conn, error) {
+	if proxy == nil {
+		return net.DialTimeout("tcp", serverAddress, handshakeTimeout)
+	}
 
-		// // Prepare the configuration of the DTLS connection
-		// config := &dtls.Config{Certificate: certificate, PrivateKey: privateKey}
+	u, err := url.Parse(proxy.Address)
+	if err != nil {
+		logger.Error("failed parsing httpProxyListener into URL", err)
+		return nil, err
+	}
 
-		// // Connect to a DTLS server
-		// conn, err = dtls.Dial("udp", addr, config)
+	// this only covers the hop to an https proxy, the tether's own verified tls runs inside the tunnel
+	proxyDialer := proxy_dialer.New(u, proxy_dialer.WithTls(&tls.Config{InsecureSkipVerify: true}))
+	if proxy.User != "" || proxy.Pass != "" {
+		prxAuth := proxy_dialer.WithProxyAuth(proxy_dialer.AuthBasic(proxy.User, proxy.Pass))
+		prxAuth(proxyDialer)
 	}
-	return conn
+	return proxyDialer.Dial("tcp", serverAddress)
 }
 
 func (rtr *Router) createSocks5Listener(socksAddr string) (net.Listener, error) {
@@ -657,7 +1052,7 @@ func (rtr *Router) createSocks5Listener(socksAddr string) (net.Listener, error)
 	return socksListener, nil
 }
 
-func (rtr *Router) handleSocks5Connection(conn net.Conn) {
+func (rtr *Router) handleSocks5Connection(conn net.Conn, udpIdleTimeout time.Duration) {
 	var cator socks5.Authenticator
 	// 5s to get the socks establishing over with
 	///conn.SetDeadline(time.Now().Add(5 * time.Second))
@@ -676,6 +1071,12 @@ func (rtr *Router) handleSocks5Connection(conn net.Conn) {
 		return
 	}
 
+	// udp is relayed by this node, only the datagrams themselves are routed
+	if req.Command == socks5.AssociateCommand {
+		rtr.handleUdpAssociate(conn, req, udpIdleTimeout)
+		return
+	}
+
 	address := req.DestAddr.Address()
 
 	// u, err := url.Parse(address)
@@ -683,10 +1084,7 @@ func (rtr *Router) handleSocks5Connection(conn net.Conn) {
 	// 	panic(err)
 	// }
 	destHost, destPort, _ := net.SplitHostPort(address)
-
-	// adding the request to this task, so it can be handled on the other side -----
-	buff := bytes.Buffer{}
-	req.WriteTo(&buff)
+	srcHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
 	task := NewTunnelTask(
 		conn,
@@ -695,13 +1093,14 @@ func (rtr *Router) handleSocks5Connection(conn net.Conn) {
 			TargetPort:    destPort,
 			TargetAddress: destHost,
 			Local:         true,
+			Source:        srcHost,
 		})
 
 	rtr.route(task)
 }
 
 // handles an incomming socks connection
-func (rtr *Router) handleSocksListener(listener net.Listener) {
+func (rtr *Router) handleSocksListener(listener net.Listener, udpIdleTimeout time.Duration) {
 	for {
 		// Accept a TCP connection
 		conn, err := listener.Accept()
@@ -709,6 +1108,6 @@ func (rtr *Router) handleSocksListener(listener net.Listener) {
 			logger.Error("Closed tcp server: ", err)
 			continue
 		}
-		go rtr.handleSocks5Connection(conn)
+		go rtr.handleSocks5Connection(conn, udpIdleTimeout)
 	}
 }
@@ -61,6 +61,7 @@ func TestRouter(t *testing.T) {
 			TargetPort:     10101,
 			TargetHost:     "localhost",
 			ConnectionType: "tls",
+			Insecure:       true,
 			ConnectionName: "stam1",
 			ClientPassword: relayPass,
 		},
@@ -131,7 +132,7 @@ func TestRouter(t *testing.T) {
 // 	config.Mapping[""] = "*"
 
 // 	rtrConf, err := readNetConfig(conn)
-// 	err = writeNetConfig(conn, &config)
+// 	err = writeNetConfig(conn, config.ClientId)
 // 	_ = err
 // 	_ = rtrConf
 // 	//sess := muxado.Client(conn,nil)
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// socks5 reply codes (RFC1928 section 6)
+const (
+	socks5Success uint8 = iota
+	socks5ServerFailure
+	socks5RuleFailure
+	socks5NetUnreachable
+	socks5HostUnreachable
+	socks5ConnRefused
+	socks5TtlExpired
+	socks5CmdNotSupported
+	socks5AddrNotSupported
+)
+
+// socks5AddrBytes encodes host:port in the socks5 ATYP, ADDR, PORT wire format
+func socks5AddrBytes(host string, port int) []byte {
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		b = append([]byte{3, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{1}, ip4...)
+	} else {
+		b = append([]byte{4}, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// writeSocks5Reply sends a socks5 reply to the client, the library keeps its own version unexported
+func writeSocks5Reply(w io.Writer, rep uint8, bindAddr net.Addr) error {
+	msg := []byte{5, rep, 0}
+	switch addr := bindAddr.(type) {
+	case *net.TCPAddr:
+		msg = append(msg, socks5AddrBytes(addr.IP.String(), addr.Port)...)
+	case *net.UDPAddr:
+		msg = append(msg, socks5AddrBytes(addr.IP.String(), addr.Port)...)
+	default:
+		msg = append(msg, socks5AddrBytes("0.0.0.0", 0)...)
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// relayed socks tasks are answered with a status frame instead of a socks5 reply, the entry node turns it into the
+// reply its client gets: the node which dialed the target (or failed somewhere along the way) sends
+// statusFrameMarker followed by a length prefixed json taskStatus, the hops in between just pass it on.
+const statusFrameMarker byte = 0xFE
+
+type taskStatus struct {
+	Rep    uint8  `json:"rep"`
+	Bind   string `json:"bind,omitempty"`   // the address the exit node connected from
+	Node   string `json:"node,omitempty"`   // the node which sent the status
+	Reason string `json:"reason,omitempty"` // what went wrong, for the entry node's log
+}
+
+// dialErrorReply maps a dial error to the socks5 reply code telling the client why it failed
+func dialErrorReply(err error) uint8 {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5HostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5TtlExpired
+	default:
+		return socks5HostUnreachable
+	}
+}
+
+// writeTaskStatus sends a status frame back towards the entry node
+func writeTaskStatus(w io.Writer, status *taskStatus) error {
+	_, err := w.Write([]byte{statusFrameMarker})
+	if err != nil {
+		return err
+	}
+	return writeJsonMessage(w, status)
+}
+
+// readTaskStatus reads the status frame answering a relayed socks task
+func readTaskStatus(r io.Reader) (*taskStatus, error) {
+	marker := []byte{0}
+	if _, err := io.ReadFull(r, marker); err != nil {
+		return nil, err
+	}
+	if marker[0] != statusFrameMarker {
+		return nil, errors.New("bad task status marker: " + strconv.Itoa(int(marker[0])))
+	}
+	status := &taskStatus{}
+	err := readJsonMessage(r, status)
+	return status, err
+}
+
+// bindAddr parses the bind address of a status, nil when there is none
+func (s *taskStatus) bindAddr() net.Addr {
+	host, port, err := net.SplitHostPort(s.Bind)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	intPort, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ip, Port: intPort}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFailureRepliesAcrossRelays(t *testing.T) {
+	// a port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %s", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	exit := NewRouter()
+	exit.NetworkConfig.ClientId = "exitNode"
+	exit.NetworkConfig.Mapping["127.0.0.1"] = "local"
+	exit.NetworkConfig.Mapping["*.blocked"] = "local"
+	exit.NetworkConfig.NetworkExports = []string{"127.0.0.1"}
+	err = exit.Serve(ListenerConfig{Port: 10381, Type: "relayTcp"})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	entry := NewRouter()
+	entry.NetworkConfig.ClientId = "entryNode"
+	entry.NetworkConfig.Mapping["*"] = "exitNode"
+	entry.NetworkConfig.Mapping["*.nowhere"] = "missingNode"
+	err = entry.Serve(ListenerConfig{Port: 10382, Type: "socks5", LocalOnly: true})
+	if err != nil {
+		t.Fatalf("failed to start socks5 listener: %s", err)
+	}
+	err = entry.Connect(&TetherConfig{TargetPort: 10381, TargetHost: "localhost", ConnectionType: "tls", Insecure: true}, 2)
+	if err != nil {
+		t.Fatalf("failed to connect tether: %s", err)
+	}
+
+	cases := []struct {
+		host string
+		port int
+		rep  byte
+	}{
+		{"127.0.0.1", closedPort, socks5ConnRefused}, // the exit node's dial fails
+		{"10.1.2.3", 80, socks5NetUnreachable},       // the exit node has no route
+		{"www.blocked", 80, socks5RuleFailure},       // the exit node doesn't export it
+		{"www.nowhere", 80, socks5NetUnreachable},    // the entry node has no connected next hop
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", "127.0.0.1:10382")
+		if err != nil {
+			t.Fatalf("failed to connect to socks5 listener: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{5, 1, 0})
+		conn.Write(append([]byte{5, ConnectCommand, 0}, socks5AddrBytes(c.host, c.port)...))
+		reply := make([]byte, 12)
+		_, err = io.ReadFull(conn, reply)
+		conn.Close()
+		if err != nil || reply[3] != c.rep {
+			t.Errorf("%s:%s expected reply %d, got: %v %v", c.host, strconv.Itoa(c.port), c.rep, reply, err)
+		}
+	}
+}
+
+func TestRawReplyIsNotAStatus(t *testing.T) {
+	// a raw socks5 reply isn't a status frame, the task fails rather than passing it on
+	if status, err := readTaskStatus(bytes.NewReader([]byte{5, 0, 0, 1})); err == nil {
+		t.Fatalf("a raw socks5 reply should be refused, got: %+v", status)
+	}
+}
+
+func TestDialErrorReply(t *testing.T) {
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	cases := []struct {
+		err error
+		rep uint8
+	}{
+		{dialErr(syscall.ECONNREFUSED), socks5ConnRefused},
+		{dialErr(syscall.ENETUNREACH), socks5NetUnreachable},
+		{dialErr(syscall.EHOSTUNREACH), socks5HostUnreachable},
+		{dialErr(syscall.ETIMEDOUT), socks5TtlExpired},
+		{errors.New("wrapped: " + dialErr(syscall.ECONNREFUSED).Error()), socks5HostUnreachable}, // only the message is left
+		{&net.DNSError{Err: "no such host", Name: "nowhere.invalid", IsNotFound: true}, socks5HostUnreachable},
+	}
+	for _, c := range cases {
+		if rep := dialErrorReply(c.err); rep != c.rep {
+			t.Errorf("%v: expected reply %d, got %d", c.err, c.rep, rep)
+		}
+	}
+}
+
+func TestUnencodableTaskIsRefused(t *testing.T) {
+	rtr := NewRouter()
+	rtr.NetworkConfig.ClientId = "encodeRelay"
+	rtr.NetworkConfig.Mapping["*"] = "encodeNext"
+	teth := NewTether(false)
+	teth.RemoteConfig = &ClientConfig{ClientId: "encodeNext"}
+	rtr.tethers["encodeNext"] = teth
+	next, _ := net.Pipe()
+	defer teth.Close()
+	if err := teth.AddConnection(next); err != nil {
+		t.Fatalf("failed adding connection: %s", err)
+	}
+
+	hugePath := []string{}
+	for i := 0; i < 10; i++ {
+		hugePath = append(hugePath, strings.Repeat("n", 500)+strconv.Itoa(i))
+	}
+	cases := []struct {
+		name string
+		info TaskInfo
+		rep  uint8
+	}{
+		{"long fqdn", TaskInfo{TargetAddress: strings.Repeat("a", 256) + ".com", TargetPort: "80"}, socks5AddrNotSupported},
+		{"bad port", TaskInfo{TargetAddress: "example.com", TargetPort: "70000"}, socks5AddrNotSupported},
+		{"large header", TaskInfo{TargetAddress: "example.com", TargetPort: "80", Hops: 1, Path: hugePath}, socks5ServerFailure},
+	}
+	for _, c := range cases {
+		local, remote := net.Pipe()
+		info := c.info
+		if len(info.Path) == 0 {
+			info.Path = []string{"client"}
+		}
+		task := NewTunnelTask(remote, &info)
+		task.Peer = info.Path[len(info.Path)-1]
+		go rtr.route(task)
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		status, err := readTaskStatus(local)
+		local.Close()
+		if err != nil || status.Rep != c.rep {
+			t.Errorf("%s: expected reply %d, got: %+v %v", c.name, c.rep, status, err)
+		}
+	}
+}
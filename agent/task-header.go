@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"teleporter/logger"
+)
+
+// every virtual connection starts with a task header:
+//
+//	magic (1) | version (1) | body length (2) | type (1) | address type (1) | address | port (2) | options
+//
+// the address is in socks5 form: 4 bytes for ipv4, 16 for ipv6, or a length byte & a domain name,
+// address type 0 means the task has no target (pings, route adverts).
+// options are TLVs: option type (1) | length (2) | value, options a node doesn't know are skipped.
+const (
+	taskHeaderMagic   byte = 0xA7
+	taskHeaderVersion byte = 1
+	maxTaskHeaderSize      = 4096 // the body, not counting magic, version & length
+)
+
+// address types, same values as socks5
+const (
+	headerAddrNone byte = 0
+	headerAddrIpv4 byte = 1
+	headerAddrFqdn byte = 3
+	headerAddrIpv6 byte = 4
+)
+
+// task header options
+const (
+	optTargetNode  byte = 1 // the node the task is addressed to
+	optHops        byte = 2 // uint8, the number of relays the task went through
+	optPathNode    byte = 3 // one of the nodes which relayed the task, repeated in path order
+	optIdleTimeout byte = 4 // uint32 seconds, how long the datagram flow of a udp task may be idle
+)
+
+// errHeaderTarget is wrapped by the encoding errors of targets a header can't carry, the other errors are about the route
+var errHeaderTarget = errors.New("target can't be carried in a task header")
+
+// maxJsonMessageSize bounds the json messages peers send us (configs, handshakes, adverts, statuses)
+const maxJsonMessageSize = 1 << 20
+
+func writeTaskInfo(conn io.Writer, tInfo *TaskInfo) error {
+	b, err := encodeTaskInfo(tInfo)
+	if err != nil {
+		logger.Error("writeTaskHeader: Problem in encoding TaskInfo: ", err)
+		return err
+	}
+	_, err = conn.Write(b)
+	if err != nil {
+		logger.Error("writeTaskHeader: Problem in writing TaskInfo: ", err)
+		return err
+	}
+	return nil
+}
+
+func readTaskInfo(conn io.Reader) (*TaskInfo, error) {
+	prefix := make([]byte, 4)
+	_, err := io.ReadFull(conn, prefix)
+	if err != nil {
+		logger.Error("readTaskInfo: failed while reading task header: ", err)
+		return nil, err
+	}
+	if prefix[0] != taskHeaderMagic {
+		return nil, errors.New("readTaskInfo: not a task header, the peer may be using an older protocol")
+	}
+	if prefix[1] != taskHeaderVersion {
+		return nil, errors.New("readTaskInfo: unsupported task header version: " + strconv.Itoa(int(prefix[1])))
+	}
+	size := int(binary.BigEndian.Uint16(prefix[2:]))
+	if size > maxTaskHeaderSize {
+		return nil, errors.New("readTaskInfo: task header too large: " + strconv.Itoa(size))
+	}
+	body, err := ReadBytes(conn, size)
+	if err != nil {
+		return nil, err
+	}
+
+	tInfo, err := decodeTaskInfo(body)
+	if err != nil {
+		logger.Error("readTaskInfo: bad task header: ", err)
+		return nil, err
+	}
+	tInfo.Local = false
+	return tInfo, nil
+}
+
+// encodeTaskInfo builds the complete header, magic & length included
+func encodeTaskInfo(tInfo *TaskInfo) ([]byte, error) {
+	body := &bytes.Buffer{}
+	body.WriteByte(byte(tInfo.Type))
+
+	port := 0
+	switch ip := net.ParseIP(tInfo.TargetAddress); {
+	case tInfo.TargetAddress == "":
+		body.WriteByte(headerAddrNone)
+	case ip == nil:
+		if len(tInfo.TargetAddress) > 255 {
+			return nil, fmt.Errorf("%w, address too long: %s", errHeaderTarget, tInfo.TargetAddress)
+		}
+		body.WriteByte(headerAddrFqdn)
+		body.WriteByte(byte(len(tInfo.TargetAddress)))
+		body.WriteString(tInfo.TargetAddress)
+	case ip.To4() != nil:
+		body.WriteByte(headerAddrIpv4)
+		body.Write(ip.To4())
+	default:
+		body.WriteByte(headerAddrIpv6)
+		body.Write(ip.To16())
+	}
+	if tInfo.TargetPort != "" {
+		var err error
+		port, err = strconv.Atoi(tInfo.TargetPort)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("%w, bad port: %s", errHeaderTarget, tInfo.TargetPort)
+		}
+	}
+	binary.Write(body, binary.BigEndian, uint16(port))
+
+	if tInfo.TargetNode != "" {
+		writeHeaderOption(body, optTargetNode, []byte(tInfo.TargetNode))
+	}
+	if tInfo.Hops > 0 {
+		if tInfo.Hops > 255 {
+			return nil, errors.New("too many hops: " + strconv.Itoa(tInfo.Hops))
+		}
+		writeHeaderOption(body, optHops, []byte{byte(tInfo.Hops)})
+	}
+	for _, node := range tInfo.Path {
+		writeHeaderOption(body, optPathNode, []byte(node))
+	}
+	if tInfo.IdleTimeout > 0 {
+		secs := make([]byte, 4)
+		binary.BigEndian.PutUint32(secs, uint32((tInfo.IdleTimeout+time.Second-1)/time.Second))
+		writeHeaderOption(body, optIdleTimeout, secs)
+	}
+
+	if body.Len() > maxTaskHeaderSize {
+		return nil, errors.New("task header too large: " + strconv.Itoa(body.Len()))
+	}
+	header := []byte{taskHeaderMagic, taskHeaderVersion, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(body.Len()))
+	return append(header, body.Bytes()...), nil
+}
+
+func writeHeaderOption(w *bytes.Buffer, optType byte, value []byte) {
+	w.WriteByte(optType)
+	binary.Write(w, binary.BigEndian, uint16(len(value)))
+	w.Write(value)
+}
+
+// decodeTaskInfo parses a header body, every length is checked against what is left of it
+func decodeTaskInfo(body []byte) (*TaskInfo, error) {
+	errShort := errors.New("truncated task header")
+	if len(body) < 2 {
+		return nil, errShort
+	}
+	tInfo := &TaskInfo{Type: TaskType(body[0])}
+	addrType := body[1]
+	body = body[2:]
+
+	switch addrType {
+	case headerAddrNone:
+	case headerAddrIpv4, headerAddrIpv6:
+		size := net.IPv4len
+		if addrType == headerAddrIpv6 {
+			size = net.IPv6len
+		}
+		if len(body) < size {
+			return nil, errShort
+		}
+		tInfo.TargetAddress = net.IP(body[:size]).String()
+		body = body[size:]
+	case headerAddrFqdn:
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			return nil, errShort
+		}
+		tInfo.TargetAddress = string(body[1 : 1+int(body[0])])
+		body = body[1+int(body[0]):]
+	default:
+		return nil, errors.New("unknown address type in task header: " + strconv.Itoa(int(addrType)))
+	}
+
+	if len(body) < 2 {
+		return nil, errShort
+	}
+	if addrType != headerAddrNone {
+		tInfo.TargetPort = strconv.Itoa(int(binary.BigEndian.Uint16(body)))
+	}
+	body = body[2:]
+
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, errShort
+		}
+		optType := body[0]
+		size := int(binary.BigEndian.Uint16(body[1:]))
+		if len(body) < 3+size {
+			return nil, errShort
+		}
+		value := body[3 : 3+size]
+		body = body[3+size:]
+
+		switch optType {
+		case optTargetNode:
+			tInfo.TargetNode = string(value)
+		case optHops:
+			if size != 1 {
+				return nil, errors.New("bad hops option in task header")
+			}
+			tInfo.Hops = int(value[0])
+		case optPathNode:
+			tInfo.Path = append(tInfo.Path, string(value))
+		case optIdleTimeout:
+			if size != 4 {
+				return nil, errors.New("bad idle timeout option in task header")
+			}
+			tInfo.IdleTimeout = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+		default:
+			logger.Debug("decodeTaskInfo: skipping unknown option: ", optType)
+		}
+	}
+	return tInfo, nil
+}
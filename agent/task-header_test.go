@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskHeaderRoundTrip(t *testing.T) {
+	headers := []*TaskInfo{
+		{Type: TaskTypeSocks, TargetAddress: "www.example.com", TargetPort: "443"},
+		{Type: TaskTypeSocks, TargetAddress: "10.1.2.3", TargetPort: "22", Hops: 2, Path: []string{"nodeA", "nodeB"}},
+		{Type: TaskTypeUdp, TargetAddress: "fd00::1", TargetPort: "53", TargetNode: "farNode"},
+		{Type: TaskTypeUdp, TargetAddress: "10.1.2.3", TargetPort: "53", IdleTimeout: 5 * time.Minute},
+		{Type: TaskTypePing},
+	}
+	for _, h := range headers {
+		b := &bytes.Buffer{}
+		if err := writeTaskInfo(b, h); err != nil {
+			t.Fatalf("failed writing header %v: %s", h, err)
+		}
+		got, err := readTaskInfo(b)
+		if err != nil {
+			t.Fatalf("failed reading header %v: %s", h, err)
+		}
+		if !reflect.DeepEqual(got, h) {
+			t.Errorf("header changed on the wire: %+v became %+v", h, got)
+		}
+	}
+}
+
+func TestTaskHeaderLimits(t *testing.T) {
+	// an old json header, or anything else, is not mistaken for a task
+	old := &bytes.Buffer{}
+	WriteString(old, `{"Type":0,"TargetAddress":"example.com","TargetPort":"80"}`)
+	if _, err := readTaskInfo(old); err == nil {
+		t.Errorf("a json header should be refused")
+	}
+
+	// the announced size is checked before anything is allocated
+	huge := []byte{taskHeaderMagic, taskHeaderVersion, 0xFF, 0xFF}
+	if _, err := readTaskInfo(bytes.NewReader(huge)); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("an oversized header should be refused, got: %v", err)
+	}
+	if _, err := encodeTaskInfo(&TaskInfo{TargetAddress: "x.com", TargetPort: "80", Path: make([]string, 2000)}); err == nil {
+		t.Errorf("we should never send an oversized header")
+	}
+
+	// lengths inside the header can't point past its end
+	for _, body := range [][]byte{
+		{0, headerAddrFqdn, 200, 'a'},
+		{0, headerAddrIpv4, 10, 0},
+		{0, headerAddrNone, 0, 0, optTargetNode, 0, 50, 'x'},
+		{0, 9, 0, 0},
+	} {
+		if _, err := decodeTaskInfo(body); err == nil {
+			t.Errorf("a malformed header was accepted: %v", body)
+		}
+	}
+
+	// options we don't know are skipped
+	h, _ := encodeTaskInfo(&TaskInfo{TargetAddress: "x.com", TargetPort: "80"})
+	h = append(h, 99, 0, 2, 'h', 'i')
+	binary.BigEndian.PutUint16(h[2:], uint16(len(h)-4))
+	got, err := readTaskInfo(bytes.NewReader(h))
+	if err != nil || got.TargetAddress != "x.com" {
+		t.Errorf("a header with an unknown option should be read: %v", err)
+	}
+}
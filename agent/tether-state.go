@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"teleporter/logger"
+)
+
+// TetherState is the health of a tether, derived from the number of physical connections in its bundle
+type TetherState int
+
+const (
+	TetherConnecting TetherState = iota // no connection was established yet
+	TetherUp                            // all of its connections are up
+	TetherDegraded                      // some of its connections are down, the supervisor is redialing them
+	TetherDown                          // no connections are left, relay side tethers are removed from the router
+)
+
+func (s TetherState) String() string {
+	switch s {
+	case TetherConnecting:
+		return "connecting"
+	case TetherUp:
+		return "up"
+	case TetherDegraded:
+		return "degraded"
+	case TetherDown:
+		return "down"
+	}
+	return "unknown"
+}
+
+// TetherEvent is published to subscribers whenever a tether changes its state
+type TetherEvent struct {
+	NodeId      string // the node on the other side, empty until the first handshake
+	Name        string // the tether's connection name or address, empty for tethers accepted by a relay listener
+	State       TetherState
+	Previous    TetherState
+	Connections int
+	Time        time.Time
+}
+
+// tetherEvents fans lifecycle events out to the subscribers, a subscriber which doesn't keep up misses events
+type tetherEvents struct {
+	mu          sync.Mutex
+	subscribers map[chan TetherEvent]struct{}
+}
+
+// Subscribe returns a channel of tether lifecycle events & a function which ends the subscription (and closes the channel)
+// events are dropped for a subscriber whose buffer is full
+func (rtr *Router) Subscribe(buffer int) (<-chan TetherEvent, func()) {
+	ch := make(chan TetherEvent, buffer)
+	rtr.events.mu.Lock()
+	if rtr.events.subscribers == nil {
+		rtr.events.subscribers = make(map[chan TetherEvent]struct{})
+	}
+	rtr.events.subscribers[ch] = struct{}{}
+	rtr.events.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			rtr.events.mu.Lock()
+			delete(rtr.events.subscribers, ch)
+			rtr.events.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (rtr *Router) publish(ev TetherEvent) {
+	logger.Info("tether ", ev.NodeId, " ", ev.Name, " is ", ev.State, " (was ", ev.Previous, "), connections: ", ev.Connections)
+	rtr.events.mu.Lock()
+	defer rtr.events.mu.Unlock()
+	for ch := range rtr.events.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			logger.Warn("Router.publish: subscriber is not keeping up, dropping tether event")
+		}
+	}
+}
+
+// tetherStateFor derives a tether's state from its bundle, size is the number of connections it should have (0: any)
+func tetherStateFor(prev TetherState, conns, size int, closed bool) TetherState {
+	switch {
+	case closed:
+		return TetherDown
+	case conns == 0 && prev == TetherConnecting:
+		return TetherConnecting
+	case conns == 0:
+		return TetherDown
+	case size > 0 && conns < size:
+		return TetherDegraded
+	}
+	return TetherUp
+}
+
+// watchTether keeps the tether's state up to date as connections come & go
+func (rtr *Router) watchTether(teth *Tether) {
+	teth.SetOnChange(func() { rtr.updateTetherState(teth) })
+}
+
+// updateTetherState recomputes the tether's state and reacts to changes: a relay side tether that is down is removed
+// (the node has to reconnect), and the routes learned through a down tether are dropped so routing falls back to other hops
+func (rtr *Router) updateTetherState(teth *Tether) {
+	closed := false
+	select {
+	case <-teth.Closed():
+		closed = true
+	default:
+	}
+
+	rtr.mu.Lock()
+	prev := teth.state
+	state := tetherStateFor(prev, teth.Len(), teth.size, closed)
+	if state == prev {
+		rtr.mu.Unlock()
+		return
+	}
+	teth.state = state
+	ev := TetherEvent{Name: teth.name, State: state, Previous: prev, Connections: teth.Len(), Time: time.Now()}
+	if teth.RemoteConfig != nil {
+		ev.NodeId = teth.RemoteConfig.ClientId
+	}
+
+	remove := false
+	if state == TetherDown {
+		if !teth.isClient && rtr.tethers[ev.NodeId] == teth {
+			delete(rtr.tethers, ev.NodeId)
+			remove = true
+		}
+		if _, ok := rtr.learned[ev.NodeId]; ok {
+			delete(rtr.learned, ev.NodeId)
+			rtr.routesVersion++
+		}
+	}
+	// published under the lock, so subscribers see a tether's events in order
+	rtr.publish(ev)
+	rtr.mu.Unlock()
+
+	// a tether which is closing already is left to it, closing it again from its own Close would deadlock
+	if remove && !closed {
+		teth.Close()
+	}
+	if state == TetherDown {
+		rtr.triggerRouteAdvert()
+	}
+}
+
+// TetherState returns the tether's current state
+func (rtr *Router) TetherState(teth *Tether) TetherState {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	return teth.state
+}
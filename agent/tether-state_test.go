@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTetherStateFor(t *testing.T) {
+	cases := []struct {
+		prev   TetherState
+		conns  int
+		size   int
+		closed bool
+		want   TetherState
+	}{
+		{TetherConnecting, 0, 3, false, TetherConnecting},
+		{TetherConnecting, 1, 3, false, TetherDegraded},
+		{TetherConnecting, 3, 3, false, TetherUp},
+		{TetherUp, 2, 3, false, TetherDegraded},
+		{TetherDegraded, 0, 3, false, TetherDown},
+		{TetherDown, 3, 3, false, TetherUp},
+		{TetherConnecting, 1, 0, false, TetherUp},
+		{TetherUp, 0, 0, false, TetherDown},
+		{TetherUp, 3, 3, true, TetherDown},
+	}
+	for _, c := range cases {
+		if got := tetherStateFor(c.prev, c.conns, c.size, c.closed); got != c.want {
+			t.Errorf("tetherStateFor(%s, %d, %d, %v) = %s, want %s", c.prev, c.conns, c.size, c.closed, got, c.want)
+		}
+	}
+}
+
+// waitForState reads events until the tether to nodeId reaches a state
+func waitForState(t *testing.T, events <-chan TetherEvent, nodeId string, state TetherState) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.NodeId == nodeId && ev.State == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("tether to %s never became %s", nodeId, state)
+		}
+	}
+}
+
+func TestTetherLifecycle(t *testing.T) {
+	relayPass := GenerateRandomString(32)
+
+	srv := NewRouter()
+	srv.NetworkConfig.ClientId = "lifecycleServer"
+	srvEvents, unsubscribe := srv.Subscribe(16)
+	defer unsubscribe()
+	err := srv.Serve(ListenerConfig{
+		Port:              10401,
+		Type:              "relayTcp",
+		UseAuthentication: true,
+		AuthorizedClients: map[string]string{
+			"lifecycleClient": relayPass,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	cli := NewRouter()
+	cli.NetworkConfig.ClientId = "lifecycleClient"
+	cliEvents, cliUnsubscribe := cli.Subscribe(16)
+	defer cliUnsubscribe()
+	err = cli.Connect(&TetherConfig{
+		TargetPort:     10401,
+		TargetHost:     "localhost",
+		ConnectionType: "tls",
+		Insecure:       true,
+		ClientPassword: relayPass,
+	}, 2)
+	if err != nil {
+		t.Fatalf("failed to connect tether: %s", err)
+	}
+	waitForState(t, cliEvents, "lifecycleServer", TetherUp)
+	waitForState(t, srvEvents, "lifecycleClient", TetherUp)
+
+	// the relay's tether is up with its first connection, a connection arriving after the close would open a new one
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		srv.mu.RLock()
+		srvTeth := srv.tethers["lifecycleClient"]
+		srv.mu.RUnlock()
+		if srvTeth != nil && srvTeth.Len() == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the relay never got both connections of the tether")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cli.mu.RLock()
+	teth := cli.tethers["lifecycleServer"]
+	cli.mu.RUnlock()
+	if teth == nil || cli.TetherState(teth) != TetherUp {
+		t.Fatalf("the client's tether should be up")
+	}
+
+	// the client goes away, the relay drops its tether & stops routing to it
+	teth.Close()
+	waitForState(t, cliEvents, "lifecycleServer", TetherDown)
+	waitForState(t, srvEvents, "lifecycleClient", TetherDown)
+
+	srv.mu.RLock()
+	_, ok := srv.tethers["lifecycleClient"]
+	srv.mu.RUnlock()
+	if ok {
+		t.Errorf("a tether that is down should be removed from the relay")
+	}
+	if teth, _ := srv.tetherTowards("lifecycleClient"); teth != nil {
+		t.Errorf("a tether that is down should not be routed to")
+	}
+	if teth, _ := cli.tetherTowards("lifecycleServer"); teth != nil {
+		t.Errorf("a closed client tether should not be routed to")
+	}
+}
+
+func TestClosingRelayTether(t *testing.T) {
+	rtr := NewRouter()
+	teth := NewTether(false)
+	teth.RemoteConfig = &ClientConfig{ClientId: "closingClient"}
+	rtr.tethers["closingClient"] = teth
+	rtr.watchTether(teth)
+	c1, _ := net.Pipe()
+	if err := teth.AddConnection(c1); err != nil {
+		t.Fatalf("failed adding connection: %s", err)
+	}
+	if rtr.TetherState(teth) != TetherUp {
+		t.Fatalf("the relay's tether should be up")
+	}
+
+	// closing an up tether drops it, without closing it again from within
+	closed := make(chan struct{})
+	go func() {
+		teth.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("closing a relay tether which is up deadlocked")
+	}
+	if rtr.TetherState(teth) != TetherDown {
+		t.Errorf("a closed tether should be down")
+	}
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	if _, ok := rtr.tethers["closingClient"]; ok {
+		t.Errorf("a closed relay tether should be removed")
+	}
+}
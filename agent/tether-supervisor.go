@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"math/rand"
+	"time"
+
+	"teleporter/logger"
+)
+
+const (
+	// handshakeTimeout limits the time a freshly dialed connection may take to exchange network configs
+	handshakeTimeout = 30 * time.Second
+
+	reconnectMinDelay = 1 * time.Second
+	reconnectMaxDelay = 2 * time.Minute
+	// reconnectStableAfter is how long a connection has to stay up before the reconnection delays start over
+	reconnectStableAfter = 30 * time.Second
+)
+
+// backoff produces jittered, exponentially growing delays between reconnection attempts
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+// Next returns the delay to wait before the next attempt, each call doubles the delay up to max
+// the returned value is randomized within [d/2, d] so that many nodes losing the same relay do not redial in lockstep
+func (b *backoff) Next() time.Duration {
+	d := b.min << b.attempt
+	if d <= 0 || d > b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Reset starts the delay sequence over, it is called once a connection proved stable
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// reconnectDelay is the wait before redialing a connection which was lost, given when the tether last got one:
+// a relay which accepts connections & drops them right away is redialed with growing delays, like a failing one
+func reconnectDelay(bo *backoff, lastConnected time.Time) time.Duration {
+	if time.Since(lastConnected) >= reconnectStableAfter {
+		bo.Reset()
+		return 0
+	}
+	return bo.Next()
+}
+
+// tetherSupervisor keeps a client side tether at its configured number of physical connections
+type tetherSupervisor struct {
+	rtr           *Router
+	teth          *Tether
+	conf          *TetherConfig
+	serverAddress string
+	size          int
+}
+
+// run waits for physical connections to drop and redials them, until the tether is closed
+func (s *tetherSupervisor) run() {
+	bo := &backoff{min: reconnectMinDelay, max: reconnectMaxDelay}
+	var lastConnected time.Time
+	for {
+		for s.teth.Len() < s.size {
+			select {
+			case <-s.teth.Closed():
+				logger.Infof("tetherSupervisor: tether to %s (%s) was closed", s.serverAddress, s.conf.ConnectionName)
+				return
+			default:
+			}
+
+			conn, remoteConf, features, err := s.rtr.dialTetherConn(s.serverAddress, s.conf)
+			if err == nil {
+				err = s.rtr.registerTether(s.teth, remoteConf, features)
+				if err != nil {
+					conn.Close()
+				}
+			}
+
+			if err != nil {
+				delay := bo.Next()
+				logger.Warnf("tetherSupervisor: failed redialing %s (%s), retrying in %v: %v", s.serverAddress, s.conf.ConnectionName, delay, err)
+				time.Sleep(delay)
+				continue
+			}
+
+			if err = s.teth.AddConnection(conn); err != nil {
+				conn.Close()
+				continue
+			}
+			lastConnected = time.Now()
+			s.rtr.triggerRouteAdvert()
+			logger.Infof("tetherSupervisor: tether to %s has %d/%d connections", s.serverAddress, s.teth.Len(), s.size)
+		}
+
+		select {
+		case <-s.teth.ConnectionLost():
+		case <-s.teth.Closed():
+			logger.Infof("tetherSupervisor: tether to %s (%s) was closed", s.serverAddress, s.conf.ConnectionName)
+			return
+		}
+
+		if delay := reconnectDelay(bo, lastConnected); delay > 0 {
+			logger.Warnf("tetherSupervisor: %s (%s) dropped a fresh connection, redialing in %v", s.serverAddress, s.conf.ConnectionName, delay)
+			select {
+			case <-time.After(delay):
+			case <-s.teth.Closed():
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	bo := &backoff{min: time.Second, max: 8 * time.Second}
+	for i, max := range []time.Duration{1, 2, 4, 8, 8, 8} {
+		d := bo.Next()
+		if d < max*time.Second/2 || d > max*time.Second {
+			t.Fatalf("attempt %d: delay %v out of range [%v, %v]", i, d, max*time.Second/2, max*time.Second)
+		}
+	}
+
+	bo.Reset()
+	if d := bo.Next(); d > time.Second {
+		t.Fatalf("delay after reset should start over, got %v", d)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	bo := &backoff{min: time.Second, max: 8 * time.Second}
+
+	// connections dropped right after they were made are redialed with growing delays
+	for i, max := range []time.Duration{1, 2, 4} {
+		if d := reconnectDelay(bo, time.Now()); d < max*time.Second/2 || d > max*time.Second {
+			t.Fatalf("drop %d: delay %v out of range [%v, %v]", i, d, max*time.Second/2, max*time.Second)
+		}
+	}
+
+	// a connection which stayed up redials right away, and the delays start over
+	if d := reconnectDelay(bo, time.Now().Add(-reconnectStableAfter)); d != 0 {
+		t.Fatalf("a stable connection should be redialed right away, got %v", d)
+	}
+	if d := reconnectDelay(bo, time.Now()); d > time.Second {
+		t.Fatalf("delays should start over after a stable connection, got %v", d)
+	}
+}
+
+func TestTetherReconnect(t *testing.T) {
+	relayPass := GenerateRandomString(32)
+
+	srv := NewRouter()
+	srv.NetworkConfig.ClientId = "reconnectServer"
+	err := srv.Serve(ListenerConfig{
+		Port:              10301,
+		Type:              "relayTcp",
+		UseAuthentication: true,
+		AuthorizedClients: map[string]string{
+			"reconnectClient": relayPass,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	cli := NewRouter()
+	cli.NetworkConfig.ClientId = "reconnectClient"
+	err = cli.Connect(&TetherConfig{
+		TargetPort:     10301,
+		TargetHost:     "localhost",
+		ConnectionType: "tls",
+		Insecure:       true,
+		ClientPassword: relayPass,
+	}, 3)
+	if err != nil {
+		t.Fatalf("failed to connect tether: %s", err)
+	}
+
+	cli.mu.RLock()
+	teth := cli.tethers["reconnectServer"]
+	cli.mu.RUnlock()
+	if teth == nil {
+		t.Fatalf("tether was not registered under the server's id")
+	}
+
+	// kill all physical connections and wait for the supervisor to bring them back
+	mm := teth.IMux.(*MultiMux)
+	mm.mu.RLock()
+	killed := append([]*physicalConn{}, mm.connections...)
+	mm.mu.RUnlock()
+	for _, sess := range killed {
+		sess.Close()
+	}
+
+	restored := func() bool {
+		mm.mu.RLock()
+		defer mm.mu.RUnlock()
+		for _, sess := range mm.connections {
+			for _, dead := range killed {
+				if sess == dead {
+					return false
+				}
+			}
+		}
+		return len(mm.connections) == 3
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !restored() {
+		if time.Now().After(deadline) {
+			t.Fatalf("tether was not restored, has %d connections", teth.Len())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
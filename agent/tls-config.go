@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"teleporter/logger"
+)
+
+// the certificate files listeners used before their paths became configurable
+const (
+	defaultCertFile = "server.crt"
+	defaultKeyFile  = "server.key"
+)
+
+// CertFingerprint returns the sha256 fingerprint of a DER encoded certificate, as pinned in a tether's "fingerprint"
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts fingerprints in the usual notations (AB:CD:.., abcd.., "sha256:" prefixed)
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(strings.TrimSpace(fp))
+	fp = strings.TrimPrefix(fp, "sha256:")
+	return strings.NewReplacer(":", "", " ", "").Replace(fp)
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in: " + file)
+	}
+	return pool, nil
+}
+
+// serverTlsConfig loads the certificate a relay listener serves,
+// when a client CA is configured, tethers must also present a certificate signed by it
+func serverTlsConfig(conf *ListenerConfig) (*tls.Config, error) {
+	certFile, keyFile := conf.CertFile, conf.KeyFile
+	if certFile == "" {
+		certFile = defaultCertFile
+	}
+	if keyFile == "" {
+		keyFile = defaultKeyFile
+	}
+
+	cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsconfig := &tls.Config{Certificates: []tls.Certificate{cer}}
+
+	if conf.ClientCaCert != "" {
+		pool, err := loadCertPool(conf.ClientCaCert)
+		if err != nil {
+			logger.Error("serverTlsConfig: failed loading client CA: ", err)
+			return nil, err
+		}
+		tlsconfig.ClientCAs = pool
+		tlsconfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsconfig, nil
+}
+
+// clientTlsConfig builds the tls configuration a tether uses for verifying the relay it dials,
+// the relay is checked against the pinned CA, the pinned certificate fingerprint, or both
+// a tether with neither verifies the relay against the system's roots, unless it explicitly asks to be insecure
+func clientTlsConfig(tConf *TetherConfig, serverAddress string) (*tls.Config, error) {
+	serverName := tConf.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(serverAddress)
+	}
+	tlsconfig := &tls.Config{ServerName: serverName}
+
+	if tConf.CaCert != "" {
+		pool, err := loadCertPool(tConf.CaCert)
+		if err != nil {
+			logger.Error("clientTlsConfig: failed loading CA: ", err)
+			return nil, err
+		}
+		tlsconfig.RootCAs = pool
+	}
+
+	if tConf.Fingerprint != "" {
+		pinned := normalizeFingerprint(tConf.Fingerprint)
+		// with a fingerprint & no CA the pin replaces chain verification, which self signed node certs can't pass
+		tlsconfig.InsecureSkipVerify = tConf.CaCert == ""
+		tlsconfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || CertFingerprint(cs.PeerCertificates[0].Raw) != pinned {
+				return errors.New("server certificate does not match the pinned fingerprint for: " + serverAddress)
+			}
+			return nil
+		}
+	}
+
+	if tConf.Insecure {
+		logger.Warn("clientTlsConfig: insecure tether to: " + serverAddress + ", the server's certificate chain is NOT verified")
+		tlsconfig.InsecureSkipVerify = true
+	}
+
+	if tConf.ClientCert != "" || tConf.ClientKey != "" {
+		cer, err := tls.LoadX509KeyPair(tConf.ClientCert, tConf.ClientKey)
+		if err != nil {
+			logger.Error("clientTlsConfig: failed loading client certificate: ", err)
+			return nil, err
+		}
+		tlsconfig.Certificates = []tls.Certificate{cer}
+	}
+	return tlsconfig, nil
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert creates a certificate signed by parent (self signed if nil) and writes it as <name>.crt/<name>.key into dir
+func writeTestCert(t *testing.T, dir, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed creating certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed marshaling key: %s", err)
+	}
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestFingerprintPinning(t *testing.T) {
+	srv := NewRouter()
+	err := srv.Serve(ListenerConfig{Port: 10341, Type: "relayTcp"})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	certPem, err := os.ReadFile(defaultCertFile)
+	if err != nil {
+		t.Fatalf("failed reading server certificate: %s", err)
+	}
+	block, _ := pem.Decode(certPem)
+
+	cli := NewRouter()
+	tConf := &TetherConfig{ConnectionType: "tls", Fingerprint: CertFingerprint(block.Bytes)}
+	conn, _, _, err := cli.dialTetherConn("localhost:10341", tConf)
+	if err != nil {
+		t.Fatalf("tether with the right fingerprint failed to connect: %s", err)
+	}
+	conn.Close()
+
+	tConf.Fingerprint = "AB:CD:" + CertFingerprint([]byte("some other certificate"))[4:]
+	if _, _, _, err := cli.dialTetherConn("localhost:10341", tConf); err == nil {
+		t.Fatalf("tether with a wrong fingerprint should not connect")
+	}
+}
+
+func TestMutualTls(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", true, nil, nil)
+	writeTestCert(t, dir, "relay", false, ca, caKey)
+	writeTestCert(t, dir, "client", false, ca, caKey)
+
+	srv := NewRouter()
+	err := srv.Serve(ListenerConfig{
+		Port:         10342,
+		Type:         "relayTcp",
+		CertFile:     filepath.Join(dir, "relay.crt"),
+		KeyFile:      filepath.Join(dir, "relay.key"),
+		ClientCaCert: filepath.Join(dir, "ca.crt"),
+	})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	cli := NewRouter()
+	tConf := &TetherConfig{
+		ConnectionType: "tls",
+		CaCert:         filepath.Join(dir, "ca.crt"),
+		ClientCert:     filepath.Join(dir, "client.crt"),
+		ClientKey:      filepath.Join(dir, "client.key"),
+	}
+	conn, _, _, err := cli.dialTetherConn("localhost:10342", tConf)
+	if err != nil {
+		t.Fatalf("tether with a valid client certificate failed to connect: %s", err)
+	}
+	conn.Close()
+
+	tConf.ClientCert, tConf.ClientKey = "", ""
+	if _, _, _, err := cli.dialTetherConn("localhost:10342", tConf); err == nil {
+		t.Fatalf("tether without a client certificate should be refused")
+	}
+
+	// the relay's certificate is not signed by a CA the tether trusts
+	tConf.CaCert = defaultCertFile
+	if _, _, _, err := cli.dialTetherConn("localhost:10342", tConf); err == nil {
+		t.Fatalf("tether should refuse a relay signed by an unknown CA")
+	}
+}
+
+func TestUnpinnedTether(t *testing.T) {
+	srv := NewRouter()
+	err := srv.Serve(ListenerConfig{Port: 10343, Type: "relayTcp"})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	// with no pin the relay is verified against the system's roots, which never signed its self signed certificate
+	cli := NewRouter()
+	tConf := &TetherConfig{ConnectionType: "tls"}
+	if _, _, _, err := cli.dialTetherConn("localhost:10343", tConf); err == nil {
+		t.Fatalf("an unpinned tether should refuse a self signed relay")
+	}
+
+	tConf.Insecure = true
+	conn, _, _, err := cli.dialTetherConn("localhost:10343", tConf)
+	if err != nil {
+		t.Fatalf("an insecure tether failed to connect: %s", err)
+	}
+	conn.Close()
+}
@@ -4,7 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 
-	"github.com/amitbet/teleporter/logger"
+	"teleporter/logger"
 )
 
 // func main() {
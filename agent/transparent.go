@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"teleporter/logger"
+)
+
+// a transparent listener accepts tcp connections redirected to it by the firewall, e.g. on the node itself:
+//
+//	iptables -t nat -A OUTPUT -p tcp -d 10.0.0.0/8 -m owner ! --uid-owner teleporter -j REDIRECT --to-ports 12345
+//
+// or for a whole lan, on its gateway: iptables -t nat -A PREROUTING -i eth1 -p tcp -j REDIRECT --to-ports 12345
+// the connection's original destination is recovered from the kernel, and the connection is routed to it as a tcp task.
+
+var errTransparentUnsupported = errors.New("transparent listeners are only supported on linux")
+
+// handleTransparentListener routes every accepted connection to the destination it was originally sent to
+func (rtr *Router) handleTransparentListener(listener net.Listener) {
+	defer listener.Close()
+	logger.Infof("Started new transparent listener at port %v\n", listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Error("Closed transparent listener: ", err)
+			return
+		}
+		go rtr.handleTransparentConnection(conn)
+	}
+}
+
+func (rtr *Router) handleTransparentConnection(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	dst, err := originalDst(tcpConn)
+	if err != nil {
+		logger.Error("Router.handleTransparentConnection: no original destination for ", conn.RemoteAddr(), ": ", err)
+		conn.Close()
+		return
+	}
+	// a connection made to the listener itself (not redirected) would be routed back to it forever
+	if local := conn.LocalAddr().(*net.TCPAddr); dst.Port == local.Port && (dst.IP.IsLoopback() || dst.IP.Equal(local.IP)) {
+		logger.Warn("Router.handleTransparentConnection: refusing ", conn.RemoteAddr(), ", it connected to the listener directly")
+		conn.Close()
+		return
+	}
+
+	srcHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	rtr.route(NewTunnelTask(conn, &TaskInfo{
+		Type:          TaskTypeTcp,
+		TargetAddress: dst.IP.String(),
+		TargetPort:    strconv.Itoa(dst.Port),
+		Local:         true,
+		Source:        srcHost,
+	}))
+}
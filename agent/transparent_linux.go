@@ -0,0 +1,60 @@
+//go:build linux
+
+package agent
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const transparentSupported = true
+
+// the netfilter socket options holding the destination of a connection before it was redirected
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST, at the SOL_IP level
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST, at the SOL_IPV6 level
+)
+
+// originalDst asks netfilter where a redirected connection was originally headed
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	isIpv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	err = raw.Control(func(fd uintptr) {
+		if isIpv4 {
+			// a sockaddr_in comes back, as big as an ipv6 mreq
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr[0]))
+			dst = &net.TCPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: ntohs(sa.Port)}
+			return
+		}
+		// a sockaddr_in6 comes back, as big as an ipv6 mtu info
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		dst = &net.TCPAddr{IP: net.IP(append([]byte{}, info.Addr.Addr[:]...)), Port: ntohs(info.Addr.Port)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, sockErr
+}
+
+// ntohs reads a port kept in network byte order in a uint16
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package agent
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// transparentNetnsEnv tells a test binary that it was started in the network namespace TestTransparentRedirect set up
+const transparentNetnsEnv = "TELEPORTER_TRANSPARENT_NETNS"
+
+func TestTransparentListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer client.Close()
+	conn := <-accepted
+	defer conn.Close()
+
+	// without a redirect netfilter either doesn't know the connection, or reports its actual destination
+	dst, err := originalDst(conn.(*net.TCPConn))
+	if err == nil && dst.String() != listener.Addr().String() {
+		t.Errorf("the original destination of a direct connection should be the listener, got: %s", dst)
+	}
+
+	// a connection made to the transparent listener directly is never routed back to it
+	rtr := NewRouter()
+	go rtr.handleTransparentConnection(conn)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("a direct connection should be closed, read %d bytes", n)
+	}
+}
+
+// TestTransparentRedirect redirects connections with iptables in a network namespace of its own,
+// and runs itself again in there to check the original destinations netfilter reports, for ipv4 & ipv6
+func TestTransparentRedirect(t *testing.T) {
+	if os.Getenv(transparentNetnsEnv) != "" {
+		checkRedirectedDestinations(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("a network namespace & iptables rules need root")
+	}
+	for _, tool := range []string{"ip", "iptables", "ip6tables"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " is not installed")
+		}
+	}
+
+	run := func(args ...string) {
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v failed: %s %s", args, err, out)
+		}
+	}
+	ns := "tptransparent" + strconv.Itoa(os.Getpid())
+	run("ip", "netns", "add", ns)
+	t.Cleanup(func() { exec.Command("ip", "netns", "delete", ns).Run() })
+	inNs := func(args ...string) { run(append([]string{"ip", "netns", "exec", ns}, args...)...) }
+
+	// the original destinations are addresses of the namespace, nothing listens on them
+	inNs("ip", "link", "set", "lo", "up")
+	inNs("ip", "addr", "add", "192.0.2.10/32", "dev", "lo")
+	inNs("ip", "addr", "add", "2001:db8::10/128", "dev", "lo", "nodad")
+	inNs("iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "192.0.2.10", "--dport", "80", "-j", "REDIRECT", "--to-ports", "10441")
+	inNs("ip6tables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "2001:db8::10", "--dport", "80", "-j", "REDIRECT", "--to-ports", "10441")
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run", "^TestTransparentRedirect$", "-test.v")
+	cmd.Env = append(os.Environ(), transparentNetnsEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("the check in the network namespace failed: %s\n%s", err, out)
+	}
+}
+
+// checkRedirectedDestinations connects to addresses which are redirected to a local listener,
+// and checks originalDst recovers the address & port each connection was made to
+func checkRedirectedDestinations(t *testing.T) {
+	for _, c := range []struct{ listen, target string }{
+		{"127.0.0.1:10441", "192.0.2.10:80"},
+		{"[::1]:10441", "[2001:db8::10]:80"},
+	} {
+		listener, err := net.Listen("tcp", c.listen)
+		if err != nil {
+			t.Fatalf("failed to listen on %s: %s", c.listen, err)
+		}
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		client, err := net.DialTimeout("tcp", c.target, 5*time.Second)
+		if err != nil {
+			t.Fatalf("failed to connect to %s: %s", c.target, err)
+		}
+		var conn net.Conn
+		select {
+		case conn = <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the connection to %s was not redirected to %s", c.target, c.listen)
+		}
+		dst, err := originalDst(conn.(*net.TCPConn))
+		if err != nil || dst.String() != c.target {
+			t.Errorf("the original destination should be %s, got: %v %v", c.target, dst, err)
+		}
+		conn.Close()
+		client.Close()
+		listener.Close()
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package agent
+
+import "net"
+
+const transparentSupported = false
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
@@ -16,9 +16,9 @@ func TestTunnelTask(t *testing.T) {
 			TargetAddress: "localhost",
 			Local:         true,
 		})
-	task.PrefixTaskInfo()
-
+	// prefixes stack up in reverse, the task info goes last so it is the first thing on the wire
 	task.PrefixSend([]byte("abcd"))
+	task.PrefixTaskInfo()
 	go server.Write([]byte("12345678901234567890"))
 
 	// this pipe simulates the relay mux connection
@@ -0,0 +1,20 @@
+package agent
+
+import "errors"
+
+// a tun listener is a vpn: it creates a tun device and terminates the tcp connections & udp flows the os routes into it
+// with a userspace tcp/ip stack (gVisor's netstack), each of them becomes a task routed by the routing rules,
+// relayed through the same tethers as socks5 traffic. the device's addresses & the routes into it are left to the
+// administrator, e.g. for a device named "teleport0":
+//
+//	ip addr add 10.255.0.1/30 dev teleport0 && ip link set teleport0 up && ip route add 10.0.0.0/8 dev teleport0
+//
+// only networks which have routing rules should be sent into the device, flows without a rule are refused rather than
+// executed locally, where the os would send them into the device again.
+
+const (
+	defaultTunDevice = "teleport0"
+	defaultTunMtu    = 1500
+)
+
+var errTunUnsupported = errors.New("tun listeners are only supported on linux")
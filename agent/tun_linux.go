@@ -0,0 +1,127 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/rawfile"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"teleporter/logger"
+)
+
+const tunSupported = true
+
+const (
+	tunNicId       = 1
+	tunMaxInFlight = 1024 // tcp handshakes in progress at once
+)
+
+// startTun opens the tun device and runs the userspace stack on it, the stack accepts connections to any address
+func (rtr *Router) startTun(conf ListenerConfig) error {
+	name := conf.Device
+	if name == "" {
+		name = defaultTunDevice
+	}
+	fd, err := tun.Open(name)
+	if err != nil {
+		return errors.New("failed to open tun device " + name + ": " + err.Error())
+	}
+	mtu := uint32(conf.Mtu)
+	if mtu == 0 {
+		mtu, err = rawfile.GetMTU(name)
+		if err != nil {
+			mtu = defaultTunMtu
+		}
+	}
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: mtu})
+	if err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	// the handlers are in place before the nic is created, packets are dispatched as soon as it is
+	idleTimeout := time.Duration(conf.UdpIdleTimeoutSecs) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUdpIdleTimeout
+	}
+	tcpForwarder := tcp.NewForwarder(s, 0, tunMaxInFlight, rtr.handleTunTcp)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		rtr.handleTunUdp(r, idleTimeout)
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	if tcpErr := s.CreateNIC(tunNicId, ep); tcpErr != nil {
+		s.Close()
+		return errors.New("failed to create the tun stack's nic: " + tcpErr.String())
+	}
+	// the flows are addressed to the rest of the network, the stack answers for every address & sends from them
+	s.SetPromiscuousMode(tunNicId, true)
+	s.SetSpoofing(tunNicId, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNicId},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNicId},
+	})
+
+	logger.Info("Started new tun listener on device ", name, ", mtu: ", mtu)
+	return nil
+}
+
+// tunTaskInfo describes a flow terminated by the stack, its local address is where the client sent it
+func tunTaskInfo(taskType TaskType, id stack.TransportEndpointID) *TaskInfo {
+	return &TaskInfo{
+		Type:          taskType,
+		TargetAddress: id.LocalAddress.String(),
+		TargetPort:    strconv.Itoa(int(id.LocalPort)),
+		Local:         false, // flows without a routing rule are refused, see tun.go
+		Source:        id.RemoteAddress.String(),
+	}
+}
+
+// handleTunTcp completes the client's handshake and routes the connection as a tcp task
+func (rtr *Router) handleTunTcp(r *tcp.ForwarderRequest) {
+	id := r.ID() // the request is released once completed
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		logger.Error("Router.handleTunTcp: failed to accept connection to ", id.LocalAddress, ": ", tcpErr)
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	rtr.route(NewTunnelTask(gonet.NewTCPConn(&wq, ep), tunTaskInfo(TaskTypeTcp, id)))
+}
+
+// handleTunUdp routes a new udp flow as a datagram task, it's called from the stack's packet path so it can't block
+func (rtr *Router) handleTunUdp(r *udp.ForwarderRequest, idleTimeout time.Duration) {
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		logger.Error("Router.handleTunUdp: failed to accept flow to ", r.ID().LocalAddress, ": ", tcpErr)
+		return
+	}
+	local, remote := net.Pipe()
+	info := tunTaskInfo(TaskTypeUdp, r.ID())
+	info.IdleTimeout = idleTimeout
+	go rtr.route(NewTunnelTask(remote, info))
+	go relayDatagrams(gonet.NewUDPConn(&wq, ep), local, idleTimeout)
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// runRedirectingProxy is a CONNECT proxy which connects every request to the same address, and reports what was asked
+func runRedirectingProxy(t *testing.T, to string, requested chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start proxy: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				requested <- req.Host
+				target, err := net.Dial("tcp", to)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTunListener(t *testing.T) {
+	echoAddr := runEchoServer(t)
+	requested := make(chan string, 1)
+
+	// the os would send anything executed here back into the device, so the test's flows leave through a proxy
+	rtr := NewRouter()
+	rtr.Proxy = &ProxyInfo{Address: "http://" + runRedirectingProxy(t, echoAddr, requested)}
+	rtr.NetworkConfig.Routes = []RouteConfig{{Cidr: "10.254.0.0/24", Action: "direct-via-proxy"}}
+	err := rtr.Serve(ListenerConfig{Type: "tun", Device: "tptest0"})
+	if err != nil {
+		t.Skipf("can't create a tun device here: %s", err)
+	}
+	for _, args := range [][]string{
+		{"addr", "add", "10.254.0.1/24", "dev", "tptest0"},
+		{"link", "set", "tptest0", "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Skipf("can't configure the tun device: %s %s", err, out)
+		}
+	}
+
+	// a connection to an address behind the device is terminated by the stack and routed by the rules
+	conn, err := net.DialTimeout("tcp", "10.254.0.2:7", 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect through the tun device: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("through the tun"))
+	buf := make([]byte, len("through the tun"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "through the tun" {
+		t.Fatalf("bad echo through the tun device: %q %v", buf, err)
+	}
+	if target := <-requested; target != "10.254.0.2:7" {
+		t.Errorf("the flow should keep its original destination, got: %s", target)
+	}
+}
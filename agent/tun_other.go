@@ -0,0 +1,9 @@
+//go:build !linux
+
+package agent
+
+const tunSupported = false
+
+func (rtr *Router) startTun(conf ListenerConfig) error {
+	return errTunUnsupported
+}
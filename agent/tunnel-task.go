@@ -2,11 +2,10 @@ package agent
 
 import (
 	"bytes"
-	"encoding/json"
-	"io"
 	"net"
+	"time"
 
-	"github.com/amitbet/teleporter/logger"
+	"teleporter/logger"
 )
 
 type TaskType uint8
@@ -14,53 +13,36 @@ type TaskType uint8
 const (
 	TaskTypeSocks = iota
 	//TaskTypeUpdateConfig
-	//TaskTypeVpn
 	TaskTypePing
+	TaskTypeUdp         // a flow of length prefixed datagrams to a single udp target
+	TaskTypeRouteAdvert // a peer's routing table, never routed any further
+	TaskTypeForward     // asks the target node to listen on a port for a reverse forward, open for as long as the port is
+	TaskTypeTcp         // a plain tcp connection to the target, its client gets no socks5 replies
 )
 
 type TaskInfo struct {
 	Type          TaskType
 	TargetAddress string //final target address (intermediate steps decided by network configurations)
 	TargetPort    string
-	Local         bool // indicates whether or not the message passed over a relay
+	Local         bool          // indicates whether or not the message passed over a relay
+	TargetNode    string        `json:",omitempty"` // set when the task is addressed to a node several hops away, which routes it from there
+	Hops          int           `json:",omitempty"` // the number of relays the task went through
+	Path          []string      `json:",omitempty"` // the nodes which relayed the task, in order, a task is never relayed by the same node twice
+	IdleTimeout   time.Duration `json:",omitempty"` // udp tasks: the flow is closed after passing no datagrams for this long
+	Source        string        `json:"-"`          // the client's address, only known where the task entered the network
 }
 
-func writeTaskInfo(conn io.Writer, tInfo *TaskInfo) error {
-	jstr, err := json.Marshal(tInfo)
-	if err != nil {
-		logger.Error("writeTaskHeader: Problem in TaskInfo json marshaling: ", err)
-		return err
-	}
-	err = WriteString(conn, string(jstr))
-	if err != nil {
-		logger.Error("writeTaskHeader: Problem in writing TaskInfo: ", err)
-		return err
-	}
-	return nil
-}
-
-func readTaskInfo(conn io.Reader) (*TaskInfo, error) {
-	taskInfoStr, err := ReadString(conn)
-	if err != nil {
-		logger.Error("Client connect, failed while reading client header: %s\n", err)
-		return nil, err
-	}
-
-	logger.Debug("Received task info string: ", taskInfoStr)
-	cconfig := TaskInfo{}
-	err = json.Unmarshal([]byte(taskInfoStr), &cconfig)
-	if err != nil {
-		logger.Error("Error unmarshaling taskInfo: %s\n", err)
-		return nil, err
-	}
-	cconfig.Local = false
-	return &cconfig, nil
-}
+// defaultMaxHops is how many relays a task may pass through unless the node configures otherwise
+const defaultMaxHops = 16
 
 type TunnelTask struct {
 	net.Conn
 	Header  *TaskInfo
+	Peer    string        // the node the task came from, empty for tasks that entered the network at this node
 	preSend *bytes.Buffer // any bytes that need to be sent to the other side before piping the connections together
+
+	// answers a client of this node which doesn't speak socks5 (http proxy clients), nil for socks5 clients
+	clientReply func(rep uint8, bind net.Addr) error
 }
 
 // ReadTunnelTask reads the task details from the connection and returns a new TunnelTask object
@@ -87,6 +69,14 @@ func NewTunnelTask(conn net.Conn, taskInfo *TaskInfo) *TunnelTask {
 	return &t
 }
 
+// answerClient tells the task's client, at the node it entered the network, how its connection attempt ended
+func (t *TunnelTask) answerClient(rep uint8, bind net.Addr) error {
+	if t.clientReply != nil {
+		return t.clientReply(rep, bind)
+	}
+	return writeSocks5Reply(t.Conn, rep, bind)
+}
+
 // ReadPresend returns the bytes that are in the presend buffer and zeroes it
 func (t *TunnelTask) ReadPresend() []byte {
 	b := t.preSend.Bytes()
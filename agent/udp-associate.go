@@ -0,0 +1,374 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amitbet/go-socks5"
+	"teleporter/logger"
+)
+
+const (
+	// defaultUdpIdleTimeout closes associations (and the flows in them) which passed no datagrams for this long
+	defaultUdpIdleTimeout = 60 * time.Second
+	// maxUdpIdleTimeout bounds the idle timeout a peer may ask for, so its flows don't hold our sockets forever
+	maxUdpIdleTimeout = time.Hour
+	// udpFlowQueueLen is the number of datagrams buffered per flow before we start dropping them, as udp would
+	udpFlowQueueLen = 64
+	maxDatagramSize = 65535
+)
+
+// writeDatagram frames a single datagram onto a stream (uint16 length + payload)
+func writeDatagram(w io.Writer, b []byte) error {
+	if len(b) > maxDatagramSize {
+		return errors.New("writeDatagram: datagram too large")
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads a single framed datagram from a stream
+func readDatagram(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseSocks5UdpHeader splits a socks5 udp request (RFC1928 section 7) into destination host, port & payload
+func parseSocks5UdpHeader(b []byte) (string, string, []byte, error) {
+	if len(b) < 4 {
+		return "", "", nil, errors.New("socks5 udp header too short")
+	}
+	if b[2] != 0 {
+		return "", "", nil, errors.New("socks5 udp fragmentation is not supported")
+	}
+
+	var host string
+	pos := 4
+	switch b[3] {
+	case 1: // ipv4
+		if len(b) < pos+net.IPv4len+2 {
+			return "", "", nil, errors.New("socks5 udp header too short")
+		}
+		host = net.IP(b[pos : pos+net.IPv4len]).String()
+		pos += net.IPv4len
+	case 4: // ipv6
+		if len(b) < pos+net.IPv6len+2 {
+			return "", "", nil, errors.New("socks5 udp header too short")
+		}
+		host = net.IP(b[pos : pos+net.IPv6len]).String()
+		pos += net.IPv6len
+	case 3: // fqdn
+		if len(b) < pos+1 || len(b) < pos+1+int(b[pos])+2 {
+			return "", "", nil, errors.New("socks5 udp header too short")
+		}
+		host = string(b[pos+1 : pos+1+int(b[pos])])
+		pos += 1 + int(b[pos])
+	default:
+		return "", "", nil, errors.New("socks5 udp header has an unknown address type")
+	}
+	port := binary.BigEndian.Uint16(b[pos:])
+	return host, strconv.Itoa(int(port)), b[pos+2:], nil
+}
+
+// udpAssociation is a single socks5 UDP ASSOCIATE session, it lives as long as the tcp control connection does
+// every destination the client sends to gets its own flow, which is routed like any other task
+type udpAssociation struct {
+	rtr         *Router
+	ctrl        net.Conn
+	pc          *net.UDPConn
+	clientIP    net.IP
+	clientAddr  *net.UDPAddr
+	idleTimeout time.Duration
+	idle        *time.Timer
+	flows       map[string]*udpFlow
+	mu          sync.Mutex
+	closeOnce   sync.Once
+}
+
+// udpFlow carries the datagrams of one association to one destination, over a single TaskTypeUdp stream
+type udpFlow struct {
+	assoc     *udpAssociation
+	key       string
+	header    []byte // the socks5 udp header prepended to every reply
+	conn      net.Conn
+	queue     chan []byte
+	idle      *time.Timer
+	closeOnce sync.Once
+}
+
+// handleUdpAssociate answers a socks5 UDP ASSOCIATE request with a fresh udp port, and relays datagrams until
+// the control connection closes or the association goes idle
+func (rtr *Router) handleUdpAssociate(conn net.Conn, req *socks5.Request, idleTimeout time.Duration) {
+	defer conn.Close()
+
+	localAddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	remoteAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if localAddr == nil || remoteAddr == nil {
+		logger.Error("handleUdpAssociate: udp associate needs a tcp control connection")
+		writeSocks5Reply(conn, socks5ServerFailure, nil)
+		return
+	}
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone})
+	if err != nil {
+		logger.Error("handleUdpAssociate: failed to open udp relay port: ", err)
+		writeSocks5Reply(conn, socks5ServerFailure, nil)
+		return
+	}
+
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUdpIdleTimeout
+	}
+	assoc := &udpAssociation{
+		rtr:         rtr,
+		ctrl:        conn,
+		pc:          pc,
+		clientIP:    remoteAddr.IP,
+		idleTimeout: idleTimeout,
+		flows:       make(map[string]*udpFlow),
+	}
+	// the client may tell us in advance which port it will be sending from
+	if req.DestAddr != nil && req.DestAddr.Port != 0 {
+		assoc.clientAddr = &net.UDPAddr{IP: remoteAddr.IP, Port: req.DestAddr.Port, Zone: remoteAddr.Zone}
+	}
+	assoc.idle = time.AfterFunc(idleTimeout, assoc.Close)
+	defer assoc.Close()
+
+	if err := writeSocks5Reply(conn, socks5Success, pc.LocalAddr()); err != nil {
+		logger.Error("handleUdpAssociate: failed to send reply: ", err)
+		return
+	}
+	logger.Debug("handleUdpAssociate: relaying datagrams for ", remoteAddr, " on ", pc.LocalAddr())
+
+	// the association ends when the client closes the control connection
+	go func() {
+		io.Copy(io.Discard, conn)
+		assoc.Close()
+	}()
+	assoc.serve()
+}
+
+// serve reads datagrams from the client and hands them to the flow of their destination
+func (a *udpAssociation) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) {
+			logger.Warn("udpAssociation: dropping datagram from a foreign address: ", from)
+			continue
+		}
+		a.mu.Lock()
+		if a.clientAddr == nil {
+			a.clientAddr = from
+		}
+		fromClient := a.clientAddr.Port == from.Port
+		a.mu.Unlock()
+		if !fromClient {
+			continue
+		}
+
+		host, port, payload, err := parseSocks5UdpHeader(buf[:n])
+		if err != nil {
+			logger.Warn("udpAssociation: dropping datagram: ", err)
+			continue
+		}
+		a.idle.Reset(a.idleTimeout)
+		a.enqueue(host, port, append([]byte{}, payload...))
+	}
+}
+
+// enqueue queues a datagram on the flow of its destination, routing a new flow if needed
+// it holds the lock throughout, so flows are never closed under our feet
+func (a *udpAssociation) enqueue(host, port string, payload []byte) {
+	key := net.JoinHostPort(host, port)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.flows == nil { // association closed
+		return
+	}
+	flow, ok := a.flows[key]
+	if !ok {
+		flow = a.newFlow(host, port)
+	}
+	select {
+	case flow.queue <- payload:
+	default:
+		logger.Debug("udpAssociation: flow queue is full, dropping datagram for: ", key)
+	}
+}
+
+// newFlow routes a new flow to the given destination, must be called with the lock held
+func (a *udpAssociation) newFlow(host, port string) *udpFlow {
+	key := net.JoinHostPort(host, port)
+
+	intPort, _ := strconv.Atoi(port)
+	local, remote := net.Pipe()
+	flow := &udpFlow{
+		assoc:  a,
+		key:    key,
+		header: append([]byte{0, 0, 0}, socks5AddrBytes(host, intPort)...),
+		conn:   local,
+		queue:  make(chan []byte, udpFlowQueueLen),
+	}
+	flow.idle = time.AfterFunc(a.idleTimeout, flow.Close)
+	a.flows[key] = flow
+
+	task := NewTunnelTask(remote, &TaskInfo{
+		Type:          TaskTypeUdp,
+		TargetAddress: host,
+		TargetPort:    port,
+		Local:         true,
+		IdleTimeout:   a.idleTimeout, // the exit node closes the flow after the same time
+	})
+	if a.clientAddr != nil {
+		task.Header.Source = a.clientAddr.IP.String()
+	}
+	go a.rtr.route(task)
+	go flow.sendLoop()
+	go flow.receiveLoop()
+	return flow
+}
+
+// sendToClient writes a reply datagram back to the socks client
+func (a *udpAssociation) sendToClient(b []byte) {
+	a.mu.Lock()
+	clientAddr := a.clientAddr
+	a.mu.Unlock()
+	if clientAddr == nil {
+		return
+	}
+	a.idle.Reset(a.idleTimeout)
+	a.pc.WriteToUDP(b, clientAddr)
+}
+
+// Close ends the association along with all of its flows
+func (a *udpAssociation) Close() {
+	a.closeOnce.Do(func() {
+		a.idle.Stop()
+		a.pc.Close()
+		a.ctrl.Close()
+
+		a.mu.Lock()
+		flows := a.flows
+		a.flows = nil
+		a.mu.Unlock()
+		for _, flow := range flows {
+			flow.Close()
+		}
+	})
+}
+
+func (f *udpFlow) sendLoop() {
+	defer f.Close()
+	for b := range f.queue {
+		if err := writeDatagram(f.conn, b); err != nil {
+			logger.Debug("udpFlow: stream closed while sending to: ", f.key, err)
+			return
+		}
+		f.idle.Reset(f.assoc.idleTimeout)
+	}
+}
+
+func (f *udpFlow) receiveLoop() {
+	defer f.Close()
+	for {
+		b, err := readDatagram(f.conn)
+		if err != nil {
+			return
+		}
+		f.idle.Reset(f.assoc.idleTimeout)
+		f.assoc.sendToClient(append(append([]byte{}, f.header...), b...))
+	}
+}
+
+// Close tears down the flow's stream and removes it from the association
+func (f *udpFlow) Close() {
+	f.closeOnce.Do(func() {
+		f.idle.Stop()
+		f.conn.Close()
+
+		a := f.assoc
+		a.mu.Lock()
+		if a.flows != nil && a.flows[f.key] == f {
+			delete(a.flows, f.key)
+		}
+		close(f.queue)
+		a.mu.Unlock()
+	})
+}
+
+// executeUdp runs a datagram flow in the local network, sending the framed datagrams of the task to its target
+// and framing the replies back, the flow is closed once it has been idle for the time set by its entry node
+func (rtr *Router) executeUdp(task *TunnelTask) {
+	defer task.Close()
+
+	idleTimeout := task.Header.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUdpIdleTimeout
+	}
+	idleTimeout = min(idleTimeout, maxUdpIdleTimeout)
+
+	target := net.JoinHostPort(task.Header.TargetAddress, task.Header.TargetPort)
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		logger.Error("Router.executeUdp: failed to dial: ", target, err)
+		return
+	}
+	relayDatagrams(conn, task, idleTimeout)
+}
+
+// relayDatagrams frames the datagrams read from conn onto the stream, and writes the framed datagrams of the stream
+// back to conn as datagrams, until either side closes or no datagram passed for idleTimeout, both are closed then
+func relayDatagrams(conn, stream net.Conn, idleTimeout time.Duration) {
+	defer conn.Close()
+	defer stream.Close()
+	idle := time.AfterFunc(idleTimeout, func() {
+		conn.Close()
+		stream.Close()
+	})
+	defer idle.Stop()
+
+	go func() {
+		defer conn.Close()
+		for {
+			b, err := readDatagram(stream)
+			if err != nil {
+				return
+			}
+			idle.Reset(idleTimeout)
+			if _, err := conn.Write(b); err != nil {
+				logger.Debug("relayDatagrams: error sending datagram to: ", conn.RemoteAddr(), err)
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		idle.Reset(idleTimeout)
+		if err := writeDatagram(stream, buf[:n]); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSocks5UdpHeader(t *testing.T) {
+	for _, host := range []string{"10.0.0.1", "::1", "example.com"} {
+		b := append([]byte{0, 0, 0}, socks5AddrBytes(host, 53)...)
+		b = append(b, "payload"...)
+
+		h, p, payload, err := parseSocks5UdpHeader(b)
+		if err != nil {
+			t.Fatalf("%s: failed to parse header: %s", host, err)
+		}
+		if h != host || p != "53" || string(payload) != "payload" {
+			t.Fatalf("%s: bad parse result: %s %s %q", host, h, p, payload)
+		}
+	}
+
+	if _, _, _, err := parseSocks5UdpHeader([]byte{0, 0, 1, 1, 10, 0, 0, 1, 0, 53}); err == nil {
+		t.Fatalf("fragmented datagrams should be refused")
+	}
+	if _, _, _, err := parseSocks5UdpHeader([]byte{0, 0, 0, 3, 20, 'a'}); err == nil {
+		t.Fatalf("truncated headers should be refused")
+	}
+}
+
+func TestUdpAssociateThroughTether(t *testing.T) {
+	// a udp echo server, to be reached from the far side of the tether
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to start echo server: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	relayPass := GenerateRandomString(32)
+	exit := NewRouter()
+	exit.NetworkConfig.ClientId = "udpExit"
+	exit.NetworkConfig.Mapping["*"] = "local"
+	err = exit.Serve(ListenerConfig{
+		Port:              10331,
+		Type:              "relayTcp",
+		UseAuthentication: true,
+		AuthorizedClients: map[string]string{"udpEntry": relayPass},
+	})
+	if err != nil {
+		t.Fatalf("failed to start relay listener: %s", err)
+	}
+
+	entry := NewRouter()
+	entry.NetworkConfig.ClientId = "udpEntry"
+	entry.NetworkConfig.Mapping["127.0.0.1"] = "udpExit"
+	err = entry.Serve(ListenerConfig{Port: 10332, Type: "socks5", LocalOnly: true})
+	if err != nil {
+		t.Fatalf("failed to start socks5 listener: %s", err)
+	}
+	err = entry.Connect(&TetherConfig{
+		TargetPort:     10331,
+		TargetHost:     "localhost",
+		ConnectionType: "tls",
+		Insecure:       true,
+		ClientPassword: relayPass,
+	}, 2)
+	if err != nil {
+		t.Fatalf("failed to connect tether: %s", err)
+	}
+
+	ctrl, err := net.Dial("tcp", "127.0.0.1:10332")
+	if err != nil {
+		t.Fatalf("failed to connect to socks5 listener: %s", err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(10 * time.Second))
+
+	ctrl.Write([]byte{5, 1, 0})
+	authReply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, authReply); err != nil || authReply[1] != 0 {
+		t.Fatalf("socks5 auth failed: %v %v", authReply, err)
+	}
+	ctrl.Write([]byte{5, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, reply); err != nil || reply[1] != 0 || reply[3] != ipv4Address {
+		t.Fatalf("udp associate failed: %v %v", reply, err)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("failed to dial udp relay: %s", err)
+	}
+	defer client.Close()
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	header := append([]byte{0, 0, 0}, socks5AddrBytes(echoAddr.IP.String(), echoAddr.Port)...)
+	datagram := append(append([]byte{}, header...), "hello udp"...)
+
+	buf := make([]byte, 2048)
+	for i := 0; i < 3; i++ {
+		client.Write(datagram)
+		client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("no echo through the tether: %s", err)
+		}
+		if !bytes.Equal(buf[:n], datagram) {
+			t.Fatalf("bad echo: %q", buf[:n])
+		}
+	}
+}
+
+func TestExecuteUdpIdleTimeout(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to start udp target: %s", err)
+	}
+	defer target.Close()
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+
+	// the entry node's timeout is honoured, rather than the exit's default
+	local, remote := net.Pipe()
+	defer local.Close()
+	go NewRouter().executeUdp(NewTunnelTask(remote, &TaskInfo{
+		Type:          TaskTypeUdp,
+		TargetAddress: targetAddr.IP.String(),
+		TargetPort:    strconv.Itoa(targetAddr.Port),
+		IdleTimeout:   time.Second,
+	}))
+	writeDatagram(local, []byte("ping"))
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readDatagram(local); err != io.EOF {
+		t.Errorf("an idle flow should be closed after its own timeout, got: %v", err)
+	}
+}
+
+func TestRelayDatagrams(t *testing.T) {
+	client, conn := net.Pipe()
+	task, stream := net.Pipe()
+	go relayDatagrams(conn, stream, time.Second)
+
+	// datagrams from the client are framed onto the task & the replies unframed back
+	go client.Write([]byte("query"))
+	b, err := readDatagram(task)
+	if err != nil || string(b) != "query" {
+		t.Fatalf("bad datagram on the task's stream: %q %v", b, err)
+	}
+	go writeDatagram(task, []byte("answer"))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("bad datagram back to the client: %q %v", buf[:n], err)
+	}
+
+	// an idle flow is closed
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(buf); err == nil {
+		t.Errorf("an idle flow should be closed")
+	}
+}
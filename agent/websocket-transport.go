@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"teleporter/logger"
+)
+
+// webSocketConn is a websocket carrying a physical tether connection,
+// it lets the http handler which owns the websocket know when the tether is done with it
+type webSocketConn struct {
+	*websocket.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *webSocketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// webSocketListener adapts an http server accepting websocket upgrades into a net.Listener,
+// so websocket connections can be handled exactly like the tls connections of a relayTcp listener
+type webSocketListener struct {
+	net.Listener
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept waits for the next websocket upgrade
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the http server, websockets upgraded afterwards are closed instead of waiting for an Accept
+func (l *webSocketListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+func (l *webSocketListener) serveWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &webSocketConn{Conn: ws, done: make(chan struct{})}
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		ws.Close()
+		return
+	}
+
+	// returning from the handler closes the websocket, so hold it until the tether lets go
+	<-conn.done
+}
+
+// createWebSocketControlListener creates a listener of type: relayWebSockets,
+// which is served over tls (wss) unless the listener sits behind a tls terminating reverse proxy
+func createWebSocketControlListener(listenAddress string, serverConf *ListenerConfig) (net.Listener, error) {
+	var tcpListener net.Listener
+	var err error
+	if serverConf.NoTls {
+		tcpListener, err = net.Listen("tcp", listenAddress)
+	} else {
+		tcpListener, err = createTlsControlListener(listenAddress, serverConf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	path := serverConf.Path
+	if path == "" {
+		path = "/"
+	}
+
+	wsListener := &webSocketListener{
+		Listener: tcpListener,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{Handler: wsListener.serveWebSocket})
+
+	go func() {
+		err := http.Serve(tcpListener, mux)
+		logger.Error("createWebSocketControlListener: http server ended: ", err)
+		wsListener.Close()
+	}()
+
+	logger.Debug("createWebSocketControlListener: Started server at " + listenAddress + path)
+	return wsListener, nil
+}
+
+// dialWebSocket opens a websocket (ws or wss) to the server, going through the http proxy if one is configured
+func dialWebSocket(tConf *TetherConfig, serverAddress string, tlsconfig *tls.Config) (net.Conn, error) {
+	rawConn, err := dialTcp(serverAddress, tConf.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "ws"
+	if tConf.ConnectionType == "wss" {
+		rawConn = tls.Client(rawConn, tlsconfig)
+		scheme = "wss"
+	}
+
+	path := tConf.Path
+	if path == "" {
+		path = "/"
+	}
+	wsConfig, err := websocket.NewConfig(scheme+"://"+serverAddress+path, "http://"+serverAddress+"/")
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	// the upgrade request should not hang on a server that accepted the tcp connection but never answers
+	rawConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	ws, err := websocket.NewClient(wsConfig, rawConn)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	rawConn.SetDeadline(time.Time{})
+
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
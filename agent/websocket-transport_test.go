@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// runConnectProxy starts a minimal http CONNECT proxy and returns its address
+func runConnectProxy(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start proxy: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					conn.Close()
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// testTetherTransport connects two routers over the given listener & tether types, and pings through the tether
+func testTetherTransport(t *testing.T, port int, serverConf ListenerConfig, tConf TetherConfig) {
+	relayPass := GenerateRandomString(32)
+	srv := NewRouter()
+	srv.NetworkConfig.ClientId = "wsServer"
+	serverConf.Port = port
+	serverConf.UseAuthentication = true
+	serverConf.AuthorizedClients = map[string]string{"wsClient": relayPass}
+	err := srv.Serve(serverConf)
+	if err != nil {
+		t.Fatalf("failed to start %s listener: %s", serverConf.Type, err)
+	}
+
+	cli := NewRouter()
+	cli.NetworkConfig.ClientId = "wsClient"
+	tConf.TargetHost = "localhost"
+	tConf.TargetPort = port
+	tConf.ClientPassword = relayPass
+	tConf.Insecure = true // the relays serve the repo's self signed test certificate
+	err = cli.Connect(&tConf, 2)
+	if err != nil {
+		t.Fatalf("failed to connect %s tether: %s", tConf.ConnectionType, err)
+	}
+
+	cli.mu.RLock()
+	teth := cli.tethers["wsServer"]
+	cli.mu.RUnlock()
+	if teth == nil || teth.Len() != 2 {
+		t.Fatalf("%s tether was not established", tConf.ConnectionType)
+	}
+
+	// a stream opened on the client side must come out of the server's tether
+	conn, err := teth.Open()
+	if err != nil {
+		t.Fatalf("failed to open stream: %s", err)
+	}
+	defer conn.Close()
+	done := make(chan uint32)
+	go func() {
+		writeTaskInfo(conn, &TaskInfo{Type: TaskTypePing})
+		conn.Write([]byte{0, 0, 0, 7})
+		pong, _ := ReadUint32(conn)
+		done <- pong
+	}()
+	select {
+	case pong := <-done:
+		if pong != 7 {
+			t.Fatalf("bad pong over %s tether: %d", tConf.ConnectionType, pong)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no pong over %s tether", tConf.ConnectionType)
+	}
+}
+
+func TestWebSocketTether(t *testing.T) {
+	testTetherTransport(t, 10311, ListenerConfig{Type: "relayWebSockets", Path: "/tether"}, TetherConfig{ConnectionType: "wss", Path: "/tether"})
+}
+
+func TestWebSocketTetherThroughProxy(t *testing.T) {
+	proxyAddr := runConnectProxy(t)
+	testTetherTransport(t, 10312, ListenerConfig{Type: "relayWebSockets", NoTls: true}, TetherConfig{
+		ConnectionType: "ws",
+		Proxy:          &ProxyInfo{Address: "http://" + proxyAddr},
+	})
+}
+
+func TestWebSocketListenerClosed(t *testing.T) {
+	l, err := createWebSocketControlListener("127.0.0.1:0", &ListenerConfig{NoTls: true})
+	if err != nil {
+		t.Fatalf("failed to start websocket listener: %s", err)
+	}
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("a closed listener should fail with net.ErrClosed, got: %v", err)
+	}
+
+	// the router stops serving a closed listener instead of spinning on its Accept
+	stopped := make(chan struct{})
+	go func() {
+		NewRouter().handleControlListener(l, &ListenerConfig{NoTls: true})
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the control listener kept accepting after being closed")
+	}
+
+	// an upgrade racing with the close is dropped rather than left waiting for an Accept
+	wsListener := &webSocketListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	close(wsListener.closed)
+	srv := httptest.NewServer(websocket.Server{Handler: wsListener.serveWebSocket})
+	defer srv.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/", "", srv.URL)
+	if err != nil {
+		t.Fatalf("failed to dial websocket: %s", err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ws.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the websocket should be closed by the server, got: %v", err)
+	}
+}
@@ -1,13 +1,24 @@
 module teleporter
 
-go 1.12
+go 1.23
 
 require (
 	github.com/amitbet/go-socks5 v0.0.0-20190221111744-e5952e1ebff2
-	github.com/amitbet/teleporter v0.0.0-20190620051951-b19f0a7e62b6
-	github.com/hashicorp/yamux v0.0.0-20181012175058-2f1d1f20f75d // indirect
 	github.com/inconshreveable/muxado v0.0.0-20160802230925-fc182d90f26e
 	github.com/mwitkow/go-http-dialer v0.0.0-20161116154839-378f744fb2b8
-	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4 // indirect
-	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80 // indirect
+	github.com/quic-go/quic-go v0.54.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.23.0
+	gvisor.dev/gvisor v0.0.0-20240916094835-a174eb65023f
+)
+
+require (
+	github.com/google/btree v1.1.2 // indirect
+	github.com/hashicorp/yamux v0.0.0-20181012175058-2f1d1f20f75d // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/time v0.5.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )